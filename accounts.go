@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 账号状态
+const (
+	accountActive      = "active"
+	accountCoolingDown = "cooling_down"
+	accountQuarantined = "quarantined"
+	accountDisabled    = "disabled"
+)
+
+// AccountConfig accounts.json 和管理接口中单个上游账号的配置。
+// Cookies 为 "name=value; name2=value2" 格式，Token 以 Authorization: Bearer 发送，
+// Headers 为该账号专用的请求头，值为空字符串时删除该请求头
+type AccountConfig struct {
+	Provider string            `json:"provider,omitempty"`
+	Name     string            `json:"name"`
+	Cookies  string            `json:"cookies,omitempty"`
+	Token    string            `json:"token,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Disabled bool              `json:"disabled,omitempty"`
+}
+
+// accountCookie 账号保存的一个 Cookie，保持原有顺序
+type accountCookie struct {
+	Name  string
+	Value string
+}
+
+// account 账号池中的一个上游账号及其使用情况
+type account struct {
+	Provider string
+	Name     string
+	cookies  []accountCookie
+	token    string
+	headers  map[string]string
+	disabled bool
+
+	coolUntil     time.Time
+	quarantined   bool
+	quarantinedAt time.Time
+	requests      int64
+	errors        int64
+	refreshes     int64
+	lastUsed      time.Time
+	lastStatus    int
+	lastError     string
+}
+
+// accountPool 一个 provider 的账号池，按轮询顺序使用。429 的账号冷却一段时间，
+// 401/403 的账号被隔离，直到通过管理接口更新凭据或恢复（ACCOUNT_QUARANTINE 大于 0 时到期后自动重试）
+type accountPool struct {
+	Provider string
+	entries  []*account
+	next     int
+}
+
+// AccountsUnavailableError 账号池中没有可用的账号，请求未发送到上游
+type AccountsUnavailableError struct {
+	Provider   string
+	RetryAfter time.Duration
+}
+
+func (e *AccountsUnavailableError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("no upstream account available for '%s', retry after %v", e.Provider, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("no upstream account available for '%s': all accounts are quarantined or disabled", e.Provider)
+}
+
+// AccountStatus 管理接口展示的账号状态，凭据只展示 Cookie 名称和 Token 的末尾几位
+type AccountStatus struct {
+	Provider      string     `json:"provider"`
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	Cookies       []string   `json:"cookies"`
+	Token         string     `json:"token,omitempty"`
+	Headers       []string   `json:"headers"`
+	Requests      int64      `json:"requests"`
+	Errors        int64      `json:"errors"`
+	Refreshes     int64      `json:"cookie_refreshes"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastUsed      *time.Time `json:"last_used,omitempty"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+}
+
+var (
+	accountPools  = make(map[string]*accountPool)
+	accountsMutex sync.Mutex
+)
+
+// parseCookies 解析 "name=value; name2=value2" 格式的 Cookie
+func parseCookies(raw string) ([]accountCookie, error) {
+	var cookies []accountCookie
+	for _, part := range strings.Split(raw, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid cookie '%s': expected name=value", part)
+		}
+		cookies = append(cookies, accountCookie{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return cookies, nil
+}
+
+// newAccount 校验配置并创建账号，未指定 provider 时使用默认 provider
+func newAccount(cfg AccountConfig) (*account, error) {
+	if cfg.Provider == "" {
+		cfg.Provider = defaultProviderName
+	}
+	name := strings.TrimSpace(cfg.Name)
+	if name == "" {
+		return nil, fmt.Errorf("account name is required")
+	}
+	cookies, err := parseCookies(cfg.Cookies)
+	if err != nil {
+		return nil, fmt.Errorf("account '%s': %v", name, err)
+	}
+	if len(cookies) == 0 && cfg.Token == "" && len(cfg.Headers) == 0 {
+		return nil, fmt.Errorf("account '%s': cookies, token or headers is required", name)
+	}
+	return &account{
+		Provider: cfg.Provider,
+		Name:     name,
+		cookies:  cookies,
+		token:    strings.TrimSpace(cfg.Token),
+		headers:  cfg.Headers,
+		disabled: cfg.Disabled,
+	}, nil
+}
+
+// loadAccounts 从 accounts.json（可选）加载上游账号，格式为 {"provider": [账号配置, ...]}
+func loadAccounts() {
+	data, err := os.ReadFile("accounts.json")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取 accounts.json 出错: %v", err)
+		}
+		return
+	}
+
+	var fileConfigs map[string][]AccountConfig
+	if err := json.Unmarshal(data, &fileConfigs); err != nil {
+		log.Printf("解析 accounts.json 出错: %v", err)
+		return
+	}
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	for provider, list := range fileConfigs {
+		for _, cfg := range list {
+			cfg.Provider = provider
+			acct, err := newAccount(cfg)
+			if err == nil {
+				err = addAccountLocked(acct)
+			}
+			if err != nil {
+				log.Printf("上游账号配置无效: %v", err)
+			}
+		}
+	}
+}
+
+// addAccountLocked 将账号加入对应 provider 的账号池，调用方需持有 accountsMutex
+func addAccountLocked(acct *account) error {
+	pool := accountPools[acct.Provider]
+	if pool == nil {
+		pool = &accountPool{Provider: acct.Provider}
+		accountPools[acct.Provider] = pool
+	}
+	if pool.find(acct.Name) != nil {
+		return fmt.Errorf("account '%s/%s' already exists", acct.Provider, acct.Name)
+	}
+	pool.entries = append(pool.entries, acct)
+	return nil
+}
+
+// accountPoolFor 返回 provider 的账号池，没有配置账号时返回 nil（请求不携带账号凭据）
+func accountPoolFor(provider string) *accountPool {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	if pool := accountPools[provider]; pool != nil && len(pool.entries) > 0 {
+		return pool
+	}
+	return nil
+}
+
+func (p *accountPool) find(name string) *account {
+	for _, acct := range p.entries {
+		if acct.Name == name {
+			return acct
+		}
+	}
+	return nil
+}
+
+// state 返回账号当前的状态，调用方需持有 accountsMutex
+func (a *account) state(now time.Time) string {
+	switch {
+	case a.disabled:
+		return accountDisabled
+	case a.quarantined && (config.AccountQuarantine <= 0 ||
+		now.Sub(a.quarantinedAt) < time.Duration(config.AccountQuarantine)*time.Second):
+		return accountQuarantined
+	case now.Before(a.coolUntil):
+		return accountCoolingDown
+	}
+	return accountActive
+}
+
+// Pick 按轮询顺序选择下一个可用的账号，跳过本次请求已经被拒绝的账号（tried）。
+// 没有可用账号时返回 AccountsUnavailableError，RetryAfter 为最早结束冷却的等待时间
+func (p *accountPool) Pick(tried map[*account]bool) (*account, error) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for i := 0; i < len(p.entries); i++ {
+		acct := p.entries[(p.next+i)%len(p.entries)]
+		if tried[acct] {
+			continue
+		}
+		switch acct.state(now) {
+		case accountActive:
+			p.next = (p.next + i + 1) % len(p.entries)
+			acct.lastUsed = now
+			return acct, nil
+		case accountCoolingDown:
+			if d := acct.coolUntil.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+		}
+	}
+	return nil, &AccountsUnavailableError{Provider: p.Provider, RetryAfter: wait}
+}
+
+// apply 为请求附加账号的 Cookie、Token 和请求头
+func (a *account) apply(req *http.Request) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if len(a.cookies) > 0 {
+		pairs := make([]string, 0, len(a.cookies))
+		for _, cookie := range a.cookies {
+			pairs = append(pairs, cookie.Name+"="+cookie.Value)
+		}
+		req.Header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	for key, value := range a.headers {
+		if value == "" {
+			req.Header.Del(key)
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+}
+
+// refreshCookies 用上游响应的 Set-Cookie 更新账号的 Cookie，调用方需持有 accountsMutex
+func (a *account) refreshCookies(resp *http.Response) {
+	updated := false
+	for _, cookie := range resp.Cookies() {
+		expired := cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now()))
+		index := -1
+		for i, existing := range a.cookies {
+			if existing.Name == cookie.Name {
+				index = i
+				break
+			}
+		}
+		switch {
+		case expired && index >= 0:
+			a.cookies = append(a.cookies[:index], a.cookies[index+1:]...)
+		case expired:
+			continue
+		case index >= 0:
+			if a.cookies[index].Value == cookie.Value {
+				continue
+			}
+			a.cookies[index].Value = cookie.Value
+		default:
+			a.cookies = append(a.cookies, accountCookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		updated = true
+	}
+	if updated {
+		a.refreshes++
+	}
+}
+
+// Report 记录账号的一次请求结果：Set-Cookie 更新账号的会话，429 进入冷却，401/403 被隔离。
+// 连接错误与账号无关，只计入错误次数
+func (p *accountPool) Report(acct *account, resp *http.Response, err error) {
+	// 判断验证页需要读取上游的响应体，在加锁之前完成，避免慢速的上游阻塞账号池
+	rejected := err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)
+	challenge := rejected && isChallengeResponse(resp, peekErrorBody(resp))
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	acct.requests++
+	if err != nil {
+		acct.errors++
+		acct.lastError = err.Error()
+		return
+	}
+
+	acct.lastStatus = resp.StatusCode
+	acct.refreshCookies(resp)
+	switch {
+	case challenge:
+		// 验证页通常针对出口 IP 或请求频率，而不是账号本身失效，只短暂冷却
+		acct.errors++
+		acct.lastError = "upstream returned a challenge page"
+		cooldown := time.Duration(config.AccountCooldown) * time.Second
+		acct.coolUntil = time.Now().Add(cooldown)
+		log.Printf("上游账号 %s/%s 遇到验证页，冷却 %v", acct.Provider, acct.Name, cooldown)
+	case rejected:
+		acct.errors++
+		acct.lastError = fmt.Sprintf("upstream returned status %d", resp.StatusCode)
+		acct.quarantined = true
+		acct.quarantinedAt = time.Now()
+		log.Printf("上游账号 %s/%s 被拒绝（状态码 %d），已隔离", acct.Provider, acct.Name, resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		acct.errors++
+		acct.lastError = "upstream rate limited"
+		cooldown := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if cooldown <= 0 {
+			cooldown = time.Duration(config.AccountCooldown) * time.Second
+		}
+		acct.coolUntil = time.Now().Add(cooldown)
+		log.Printf("上游账号 %s/%s 被限流，冷却 %v", acct.Provider, acct.Name, cooldown)
+	case resp.StatusCode >= 400:
+		acct.errors++
+		acct.lastError = fmt.Sprintf("upstream returned status %d", resp.StatusCode)
+	default:
+		if acct.quarantined {
+			log.Printf("上游账号 %s/%s 已恢复", acct.Provider, acct.Name)
+		}
+		acct.quarantined = false
+	}
+}
+
+// accountRejected 判断上游是否因为账号本身拒绝了请求，此时换一个账号重试
+func accountRejected(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+// maskSecret 只保留末尾 4 位
+func maskSecret(s string) string {
+	if len(s) <= 4 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// status 返回账号的状态，调用方需持有 accountsMutex
+func (a *account) status(now time.Time) AccountStatus {
+	s := AccountStatus{
+		Provider:   a.Provider,
+		Name:       a.Name,
+		State:      a.state(now),
+		Cookies:    []string{},
+		Headers:    []string{},
+		Requests:   a.requests,
+		Errors:     a.errors,
+		Refreshes:  a.refreshes,
+		LastStatus: a.lastStatus,
+		LastError:  a.lastError,
+	}
+	for _, cookie := range a.cookies {
+		s.Cookies = append(s.Cookies, cookie.Name)
+	}
+	for key := range a.headers {
+		s.Headers = append(s.Headers, key)
+	}
+	sort.Strings(s.Headers)
+	if a.token != "" {
+		s.Token = maskSecret(a.token)
+	}
+	if !a.lastUsed.IsZero() {
+		lastUsed := a.lastUsed
+		s.LastUsed = &lastUsed
+	}
+	if now.Before(a.coolUntil) {
+		coolUntil := a.coolUntil
+		s.CooldownUntil = &coolUntil
+	}
+	return s
+}
+
+// getAccountsData 返回所有上游账号的状态
+func getAccountsData() []AccountStatus {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	now := time.Now()
+	result := []AccountStatus{}
+	for _, pool := range accountPools {
+		for _, acct := range pool.entries {
+			result = append(result, acct.status(now))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// handleAdminListAccounts 列出所有上游账号
+func handleAdminListAccounts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"accounts": getAccountsData()})
+}
+
+// handleAdminAddAccount 添加上游账号
+func handleAdminAddAccount(c *gin.Context) {
+	var cfg AccountConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
+		return
+	}
+	acct, err := newAccount(cfg)
+	if err != nil {
+		writeAPIError(c, errInvalidRequest("", "", err.Error()))
+		return
+	}
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	if err := addAccountLocked(acct); err != nil {
+		writeAPIError(c, &APIError{Status: http.StatusConflict, Type: errTypeInvalidRequest, Code: "account_exists", Message: err.Error()})
+		return
+	}
+	log.Printf("已添加上游账号 %s/%s", acct.Provider, acct.Name)
+	c.JSON(http.StatusCreated, acct.status(time.Now()))
+}
+
+// findAccountLocked 按路径参数查找账号，找不到时输出 404，调用方需持有 accountsMutex
+func findAccountLocked(c *gin.Context) (*accountPool, *account) {
+	provider, name := c.Param("provider"), c.Param("name")
+	if pool := accountPools[provider]; pool != nil {
+		if acct := pool.find(name); acct != nil {
+			return pool, acct
+		}
+	}
+	writeAPIError(c, errNotFound("", "account_not_found", fmt.Sprintf("Account '%s/%s' not found.", provider, name)))
+	return nil, nil
+}
+
+// handleAdminUpdateAccount 替换账号的凭据（用于刷新过期的会话），同时解除隔离和冷却
+func handleAdminUpdateAccount(c *gin.Context) {
+	var cfg AccountConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
+		return
+	}
+	cfg.Provider, cfg.Name = c.Param("provider"), c.Param("name")
+	updated, err := newAccount(cfg)
+	if err != nil {
+		writeAPIError(c, errInvalidRequest("", "", err.Error()))
+		return
+	}
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	_, acct := findAccountLocked(c)
+	if acct == nil {
+		return
+	}
+	acct.cookies, acct.token, acct.headers, acct.disabled = updated.cookies, updated.token, updated.headers, updated.disabled
+	acct.quarantined = false
+	acct.coolUntil = time.Time{}
+	log.Printf("已更新上游账号 %s/%s 的凭据", acct.Provider, acct.Name)
+	c.JSON(http.StatusOK, acct.status(time.Now()))
+}
+
+// handleAdminResetAccount 解除账号的隔离和冷却，不修改凭据
+func handleAdminResetAccount(c *gin.Context) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	_, acct := findAccountLocked(c)
+	if acct == nil {
+		return
+	}
+	acct.quarantined = false
+	acct.coolUntil = time.Time{}
+	log.Printf("已恢复上游账号 %s/%s", acct.Provider, acct.Name)
+	c.JSON(http.StatusOK, acct.status(time.Now()))
+}
+
+// handleAdminDeleteAccount 删除上游账号
+func handleAdminDeleteAccount(c *gin.Context) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	pool, acct := findAccountLocked(c)
+	if acct == nil {
+		return
+	}
+	for i, entry := range pool.entries {
+		if entry == acct {
+			pool.entries = append(pool.entries[:i], pool.entries[i+1:]...)
+			break
+		}
+	}
+	if pool.next >= len(pool.entries) {
+		pool.next = 0
+	}
+	log.Printf("已删除上游账号 %s/%s", acct.Provider, acct.Name)
+	c.JSON(http.StatusOK, gin.H{"provider": acct.Provider, "name": acct.Name, "deleted": true})
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AnthropicContent Anthropic 消息内容，兼容字符串和内容块数组两种格式
+type AnthropicContent struct {
+	Text   string
+	Blocks []AnthropicContentBlock
+}
+
+// AnthropicContentBlock Anthropic 内容块
+type AnthropicContentBlock struct {
+	Type      string            `json:"type"`
+	Text      string            `json:"text,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Input     json.RawMessage   `json:"input,omitempty"`
+	ToolUseID string            `json:"tool_use_id,omitempty"`
+	Content   *AnthropicContent `json:"content,omitempty"`
+	IsError   bool              `json:"is_error,omitempty"`
+	Source    json.RawMessage   `json:"source,omitempty"`
+}
+
+// AnthropicMessage Anthropic 消息结构
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicTool Anthropic 工具定义
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+// AnthropicToolChoice Anthropic 工具选择
+type AnthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// AnthropicMessagesRequest /v1/messages 请求结构
+type AnthropicMessagesRequest struct {
+	Model         string               `json:"model"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	System        *AnthropicContent    `json:"system,omitempty"`
+	MaxTokens     int                  `json:"max_tokens"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	TopK          *int                 `json:"top_k,omitempty"`
+	Metadata      json.RawMessage      `json:"metadata,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	// PromptTemplate 扩展字段，引用服务端的提示词模板
+	PromptTemplate *PromptTemplateRef `json:"prompt_template,omitempty"`
+}
+
+// AnthropicUsage Anthropic 用量统计
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicMessageResponse /v1/messages 非流式响应结构
+type AnthropicMessageResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// UnmarshalJSON 同时接受字符串和内容块数组
+func (a *AnthropicContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*a = AnthropicContent{}
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if data[0] == '"' {
+		return json.Unmarshal(data, &a.Text)
+	}
+	if data[0] == '[' {
+		return json.Unmarshal(data, &a.Blocks)
+	}
+	return fmt.Errorf("content must be a string or an array of content blocks")
+}
+
+// MarshalJSON 有内容块时输出数组，否则输出字符串
+func (a AnthropicContent) MarshalJSON() ([]byte, error) {
+	if a.Blocks != nil {
+		return json.Marshal(a.Blocks)
+	}
+	return json.Marshal(a.Text)
+}
+
+// plainText 提取内容中的文本，遇到非文本块时返回错误
+func (a AnthropicContent) plainText(param string) (string, error) {
+	if a.Blocks == nil {
+		return a.Text, nil
+	}
+	texts := make([]string, 0, len(a.Blocks))
+	for i, block := range a.Blocks {
+		if block.Type != "text" {
+			return "", &ContentError{
+				Param:   fmt.Sprintf("%s[%d]", param, i),
+				Message: fmt.Sprintf("%s[%d]: content block type '%s' is not supported here", param, i, block.Type),
+				Code:    "unsupported_content_type",
+			}
+		}
+		texts = append(texts, block.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// writeAnthropicError 按 Anthropic 格式输出错误
+func writeAnthropicError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, anthropicErrorBody(errType, message))
+}
+
+// anthropicErrorBody Anthropic 格式的错误响应体，流式响应中同时作为 error 事件的数据
+func anthropicErrorBody(errType, message string) gin.H {
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	}
+}
+
+// anthropicErrorType 按状态码推断 Anthropic 错误类型
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusBadRequest:
+		return "invalid_request_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == 529 || status == http.StatusServiceUnavailable:
+		return "overloaded_error"
+	}
+	return "api_error"
+}
+
+// anthropicToChatMessages 将 Anthropic 消息转换为 OpenAI 消息，复用同一套历史构建逻辑
+func anthropicToChatMessages(req *AnthropicMessagesRequest) ([]ChatMessage, error) {
+	messages := []ChatMessage{}
+
+	if req.System != nil {
+		system, err := req.System.plainText("system")
+		if err != nil {
+			return nil, err
+		}
+		if system != "" {
+			messages = append(messages, ChatMessage{Role: "system", Content: textContent(system)})
+		}
+	}
+
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("messages[%d].role: unexpected role '%s', expected 'user' or 'assistant'", i, msg.Role)
+		}
+		if msg.Content.Blocks == nil {
+			messages = append(messages, ChatMessage{Role: msg.Role, Content: textContent(msg.Content.Text)})
+			continue
+		}
+
+		texts := []string{}
+		chatMsg := ChatMessage{Role: msg.Role}
+		for j, block := range msg.Content.Blocks {
+			param := fmt.Sprintf("messages[%d].content[%d]", i, j)
+			switch block.Type {
+			case "text":
+				texts = append(texts, block.Text)
+			case "tool_use":
+				if msg.Role != "assistant" {
+					return nil, fmt.Errorf("%s: tool_use blocks are only allowed in assistant messages", param)
+				}
+				input := string(bytes.TrimSpace(block.Input))
+				if input == "" {
+					input = "{}"
+				}
+				chatMsg.ToolCalls = append(chatMsg.ToolCalls, ToolCall{
+					ID:       block.ID,
+					Type:     "function",
+					Function: FunctionCall{Name: block.Name, Arguments: input},
+				})
+			case "tool_result":
+				if msg.Role != "user" {
+					return nil, fmt.Errorf("%s: tool_result blocks are only allowed in user messages", param)
+				}
+				result := ""
+				if block.Content != nil {
+					var err error
+					if result, err = block.Content.plainText(param + ".content"); err != nil {
+						return nil, err
+					}
+				}
+				if block.IsError {
+					result = "Error: " + result
+				}
+				messages = append(messages, ChatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: textContent(result)})
+			case "thinking", "redacted_thinking":
+				// 思考内容不回传给上游
+			default:
+				return nil, &ContentError{
+					Param:   param,
+					Message: fmt.Sprintf("%s: content block type '%s' is not supported by this model", param, block.Type),
+					Code:    "unsupported_content_type",
+				}
+			}
+		}
+
+		if len(texts) > 0 || len(chatMsg.ToolCalls) > 0 {
+			chatMsg.Content = textContent(strings.Join(texts, "\n"))
+			messages = append(messages, chatMsg)
+		}
+	}
+	return messages, nil
+}
+
+// anthropicToolSettings 将 Anthropic 工具定义转换为工具调用模拟设置
+func anthropicToolSettings(req *AnthropicMessagesRequest) (*toolSettings, error) {
+	if len(req.Tools) == 0 {
+		return nil, nil
+	}
+
+	settings := &toolSettings{Choice: "auto", Parallel: true}
+	for i, tool := range req.Tools {
+		if tool.Name == "" {
+			return nil, fmt.Errorf("tools[%d].name is required", i)
+		}
+		settings.Tools = append(settings.Tools, Tool{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if choice := req.ToolChoice; choice != nil {
+		settings.Parallel = !choice.DisableParallelToolUse
+		switch choice.Type {
+		case "", "auto":
+		case "any":
+			settings.Choice = "required"
+		case "none":
+			settings.Choice = "none"
+		case "tool":
+			if choice.Name == "" {
+				return nil, fmt.Errorf("tool_choice.name is required when type is 'tool'")
+			}
+			found := false
+			for _, tool := range settings.Tools {
+				if tool.Function.Name == choice.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("tool_choice.name: unknown tool '%s'", choice.Name)
+			}
+			settings.Choice = "function"
+			settings.Forced = choice.Name
+		default:
+			return nil, fmt.Errorf("tool_choice.type: invalid value '%s'", choice.Type)
+		}
+	}
+	return settings, nil
+}
+
+// anthropicToolUseID 将工具调用 ID 转换为 Anthropic 风格
+func anthropicToolUseID(id string) string {
+	return "toolu_" + strings.TrimPrefix(id, "call_")
+}
+
+// anthropicToolInput 将参数字符串转换为 tool_use 块的 input 对象
+func anthropicToolInput(arguments string) json.RawMessage {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &obj); err != nil || obj == nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+func anthropicMessages(c *gin.Context) {
+	startTime := time.Now()
+
+	var req AnthropicMessagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", "Invalid request body: "+err.Error())
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", "messages: at least one message is required")
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	if req.MaxTokens <= 0 {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", "max_tokens: must be greater than 0")
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 展开引用的提示词模板
+	model, templatePrompt, err := resolvePromptTemplate(c, req.Model, req.PromptTemplate)
+	if err != nil {
+		apiErr := requestAPIError(err, "prompt_template")
+		writeAnthropicError(c, apiErr.Status, anthropicErrorType(apiErr.Status), apiErr.Message)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	req.Model = model
+
+	// 应用默认配置
+	if req.Model == "" {
+		req.Model = config.DefaultModel
+	}
+	if req.Temperature == nil {
+		req.Temperature = &config.DefaultTemp
+	}
+
+	tools, err := anthropicToolSettings(&req)
+	if err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	chatMessages, err := anthropicToChatMessages(&req)
+	if err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	// 与 Anthropic 一致，末尾的助手消息作为回复的开头，响应只包含续写的内容
+	chatMessages, prefill := splitPrefill(chatMessages)
+	messagesHistory, err := buildMessagesHistory(prependSystemPrompt(chatMessages, templatePrompt), req.Model, buildToolPrompt(tools))
+	if err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	messagesHistory = appendPrefillInstruction(messagesHistory, prefill)
+	messagesHistory, err = fitContext(c, messagesHistory, req.Model, req.MaxTokens)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAnthropicError(c, apiErr.Status, anthropicErrorType(apiErr.Status), apiErr.Message)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+
+	talkAIReq := TalkAIRequest{
+		Type:            "chat",
+		MessagesHistory: messagesHistory,
+		Settings: map[string]interface{}{
+			"model":       req.Model,
+			"temperature": req.Temperature,
+		},
+		prefill: prefill,
+	}
+
+	stream, err := openStream(c.Request.Context(), talkAIReq)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAnthropicError(c, apiErr.Status, anthropicErrorType(apiErr.Status), apiErr.Message)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	defer stream.Close()
+
+	limiter := newOutputLimiter(req.StopSequences, req.MaxTokens)
+	inputTokens := estimatePromptTokens(messagesHistory)
+	if req.Stream {
+		err = handleAnthropicStream(c, stream, req.Model, tools, limiter, inputTokens)
+	} else {
+		err = handleAnthropicMessage(c, stream, req.Model, tools, limiter, inputTokens)
+	}
+	if err != nil {
+		// 流式响应已经发送了 error 事件
+		apiErr := upstreamAPIError(err)
+		if !req.Stream {
+			writeAnthropicError(c, apiErr.Status, anthropicErrorType(apiErr.Status), apiErr.Message)
+		}
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	trackRequest(c, startTime, http.StatusOK)
+}
+
+func newAnthropicMessageID() string {
+	return "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// anthropicStopReason 将 limiter 的结束原因转换为 stop_reason 和 stop_sequence
+func anthropicStopReason(limiter *outputLimiter) (string, *string) {
+	if limiter.FinishReason() == "length" {
+		return "max_tokens", nil
+	}
+	if stop := limiter.StopSequence(); stop != "" {
+		return "stop_sequence", &stop
+	}
+	return "end_turn", nil
+}
+
+// handleAnthropicMessage 读取上游出错时不写入响应，返回错误由调用方输出
+func handleAnthropicMessage(c *gin.Context, stream EventStream, model string, tools *toolSettings, limiter *outputLimiter, inputTokens int) error {
+	content, err := aggregateStreamContent(stream, limiter)
+	if err != nil {
+		return err
+	}
+
+	blocks := []AnthropicContentBlock{}
+	stopReason, stopSequence := anthropicStopReason(limiter)
+	text := content
+	var calls []ToolCall
+	if tools.enabled() {
+		text, calls = parseToolCalls(content, tools)
+	}
+	if text != "" || len(calls) == 0 {
+		blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: text})
+	}
+	for _, call := range calls {
+		blocks = append(blocks, AnthropicContentBlock{
+			Type:  "tool_use",
+			ID:    anthropicToolUseID(call.ID),
+			Name:  call.Function.Name,
+			Input: anthropicToolInput(call.Function.Arguments),
+		})
+	}
+	if len(calls) > 0 {
+		stopReason, stopSequence = "tool_use", nil
+	}
+
+	c.JSON(http.StatusOK, AnthropicMessageResponse{
+		ID:           newAnthropicMessageID(),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        model,
+		Content:      blocks,
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage:        AnthropicUsage{InputTokens: inputTokens, OutputTokens: estimateTokens(content)},
+	})
+	return nil
+}
+
+// handleAnthropicStream 读取上游出错时与 Anthropic 一致发送 error 事件并结束响应，返回该错误
+func handleAnthropicStream(c *gin.Context, stream EventStream, model string, tools *toolSettings, limiter *outputLimiter, inputTokens int) error {
+	// 设置流式响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	var streamErr error
+	c.Stream(func(w io.Writer) bool {
+		sendEvent := func(event string, data interface{}) {
+			jsonData, _ := json.Marshal(data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, string(jsonData))
+			w.(http.Flusher).Flush()
+		}
+
+		sendEvent("message_start", gin.H{
+			"type": "message_start",
+			"message": AnthropicMessageResponse{
+				ID:      newAnthropicMessageID(),
+				Type:    "message",
+				Role:    "assistant",
+				Model:   model,
+				Content: []AnthropicContentBlock{},
+				Usage:   AnthropicUsage{InputTokens: inputTokens},
+			},
+		})
+		sendEvent("ping", gin.H{"type": "ping"})
+
+		// 当前打开的内容块，-1 表示没有
+		blockIndex := -1
+		blockType := ""
+		nextIndex := 0
+		openBlock := func(kind string, block gin.H) {
+			if blockIndex >= 0 {
+				sendEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+			}
+			blockIndex = nextIndex
+			blockType = kind
+			nextIndex++
+			sendEvent("content_block_start", gin.H{"type": "content_block_start", "index": blockIndex, "content_block": block})
+		}
+		sendText := func(text string) {
+			if blockType != "text" {
+				openBlock("text", gin.H{"type": "text", "text": ""})
+			}
+			sendEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "text_delta", "text": text},
+			})
+		}
+
+		var parser *toolCallParser
+		if tools.enabled() {
+			parser = newToolCallParser(tools)
+		}
+		sendEvents := func(events []toolEvent) {
+			for _, ev := range events {
+				switch ev.Kind {
+				case toolEventText:
+					sendText(ev.Text)
+				case toolEventStart:
+					openBlock("tool_use", gin.H{"type": "tool_use", "id": anthropicToolUseID(ev.ID), "name": ev.Name, "input": gin.H{}})
+				case toolEventArgs:
+					sendEvent("content_block_delta", gin.H{
+						"type":  "content_block_delta",
+						"index": blockIndex,
+						"delta": gin.H{"type": "input_json_delta", "partial_json": ev.Text},
+					})
+				}
+			}
+		}
+
+		var output tokenCounter
+		send := func(content string) {
+			if content == "" {
+				return
+			}
+			output.Add(content)
+			if parser != nil {
+				sendEvents(parser.Feed(content))
+			} else {
+				sendText(content)
+			}
+		}
+		streamErr = forEachStreamChunk(stream, func(content string) bool {
+			out, done := limiter.Feed(content)
+			send(out)
+			return !done
+		})
+		if streamErr != nil {
+			apiErr := upstreamAPIError(streamErr)
+			sendEvent("error", anthropicErrorBody(anthropicErrorType(apiErr.Status), apiErr.Message))
+			return false
+		}
+		send(limiter.Flush())
+
+		stopReason, stopSequence := anthropicStopReason(limiter)
+		if parser != nil {
+			sendEvents(parser.Flush())
+			if parser.Count() > 0 {
+				stopReason, stopSequence = "tool_use", nil
+			}
+		}
+		if blockIndex < 0 {
+			openBlock("text", gin.H{"type": "text", "text": ""})
+		}
+		sendEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+
+		sendEvent("message_delta", gin.H{
+			"type":  "message_delta",
+			"delta": gin.H{"stop_reason": stopReason, "stop_sequence": stopSequence},
+			"usage": gin.H{"output_tokens": output.Count()},
+		})
+		sendEvent("message_stop", gin.H{"type": "message_stop"})
+		return false
+	})
+	return streamErr
+}
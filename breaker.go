@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// breakerState 熔断器状态
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker 单个上游 + 模型的熔断器。连续失败达到阈值后打开，打开期间直接拒绝请求；
+// 冷却时间过后进入半开状态，只放行一个探测请求，成功则关闭，失败则重新打开
+type circuitBreaker struct {
+	Upstream string
+	Model    string
+
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	lastError string
+	opens     int64
+	rejected  int64
+	lastUsed  time.Time
+}
+
+// CircuitOpenError 熔断器处于打开状态，请求未发送到上游
+type CircuitOpenError struct {
+	Upstream   string
+	Model      string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s/%s, retry after %v", e.Upstream, e.Model, e.RetryAfter.Round(time.Second))
+}
+
+// BreakerStatus Dashboard 展示的熔断器状态
+type BreakerStatus struct {
+	Upstream            string     `json:"upstream"`
+	Model               string     `json:"model"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	Opens               int64      `json:"opens"`
+	Rejected            int64      `json:"rejected"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// maxBreakers 熔断器数量上限。模型名来自客户端请求，不限制时每个新模型名都会留下一个熔断器
+const maxBreakers = 1024
+
+var (
+	breakers      = make(map[string]*circuitBreaker)
+	breakersMutex sync.Mutex
+)
+
+// breakerFor 返回上游 + 模型对应的熔断器，不存在时创建。数量达到上限时先淘汰一个最久未使用的熔断器
+func breakerFor(upstream, model string) *circuitBreaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	key := upstream + "/" + model
+	b, ok := breakers[key]
+	if !ok {
+		if len(breakers) >= maxBreakers {
+			evictBreakerLocked()
+		}
+		b = &circuitBreaker{Upstream: upstream, Model: model}
+		breakers[key] = b
+	}
+	b.lastUsed = time.Now()
+	return b
+}
+
+// evictBreakerLocked 淘汰最久未使用的空闲熔断器（关闭状态且没有连续失败），
+// 没有空闲的熔断器时淘汰最久未使用的一个。调用方需持有 breakersMutex
+func evictBreakerLocked() {
+	var idleKey, oldestKey string
+	var idleAt, oldestAt time.Time
+	for key, b := range breakers {
+		if oldestKey == "" || b.lastUsed.Before(oldestAt) {
+			oldestKey, oldestAt = key, b.lastUsed
+		}
+		idle := b.state == breakerClosed && b.failures == 0 && !b.probing
+		if idle && (idleKey == "" || b.lastUsed.Before(idleAt)) {
+			idleKey, idleAt = key, b.lastUsed
+		}
+	}
+	if idleKey != "" {
+		delete(breakers, idleKey)
+		return
+	}
+	delete(breakers, oldestKey)
+}
+
+// Allow 判断是否可以向上游发送请求。半开状态下只允许一个探测请求同时进行，
+// probe 为 true 表示本次请求是探测请求，需要把它传给 Record
+func (b *circuitBreaker) Allow() (probe bool, err error) {
+	if config.BreakerFailureThreshold <= 0 {
+		return false, nil
+	}
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	openDuration := time.Duration(config.BreakerOpenSeconds) * time.Second
+	if b.state == breakerOpen {
+		if wait := openDuration - time.Since(b.openedAt); wait > 0 {
+			b.rejected++
+			return false, &CircuitOpenError{Upstream: b.Upstream, Model: b.Model, RetryAfter: wait}
+		}
+		b.state = breakerHalfOpen
+		log.Printf("熔断器 %s/%s 进入半开状态，发送探测请求", b.Upstream, b.Model)
+	}
+	if b.state == breakerHalfOpen {
+		if b.probing {
+			b.rejected++
+			return false, &CircuitOpenError{Upstream: b.Upstream, Model: b.Model, RetryAfter: time.Second}
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// breakerFailure 判断错误是否说明上游不可用：连接错误和 5xx。
+// 429、其他 4xx 说明上游可以正常响应，客户端断开和账号池耗尽与上游无关
+func breakerFailure(ctx context.Context, err error) bool {
+	var accountsErr *AccountsUnavailableError
+	if err == nil || ctx.Err() != nil || errors.As(err, &accountsErr) {
+		return false
+	}
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// Record 记录一次上游请求的结果，probe 为 Allow 的返回值
+func (b *circuitBreaker) Record(ctx context.Context, probe bool, err error) {
+	if config.BreakerFailureThreshold <= 0 {
+		return
+	}
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if !breakerFailure(ctx, err) {
+		// 客户端断开时无法判断上游是否恢复，半开状态保持不变，等待下一个探测请求
+		if ctx.Err() != nil {
+			return
+		}
+		if b.state != breakerClosed {
+			log.Printf("熔断器 %s/%s 探测成功，已关闭", b.Upstream, b.Model)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if (probe && b.state == breakerHalfOpen) || b.failures >= config.BreakerFailureThreshold {
+		if b.state != breakerOpen {
+			b.opens++
+			log.Printf("熔断器 %s/%s 已打开（连续失败 %d 次），%d 秒内直接拒绝请求: %v",
+				b.Upstream, b.Model, b.failures, config.BreakerOpenSeconds, err)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// getBreakersData 返回所有熔断器的状态
+func getBreakersData() []BreakerStatus {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	openDuration := time.Duration(config.BreakerOpenSeconds) * time.Second
+	result := make([]BreakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		state := b.state
+		// 冷却时间已过但还没有新请求时，展示为半开
+		if state == breakerOpen && time.Since(b.openedAt) >= openDuration {
+			state = breakerHalfOpen
+		}
+		status := BreakerStatus{
+			Upstream:            b.Upstream,
+			Model:               b.Model,
+			State:               state.String(),
+			ConsecutiveFailures: b.failures,
+			Opens:               b.opens,
+			Rejected:            b.rejected,
+			LastError:           b.lastError,
+		}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Upstream != result[j].Upstream {
+			return result[i].Upstream < result[j].Upstream
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// maxChoices n 的上限，每个 choice 都对应一次上游请求
+const maxChoices = 8
+
+// validateChoiceCount 检查 n 参数
+func validateChoiceCount(n *int) error {
+	if n == nil {
+		return nil
+	}
+	if *n < 1 || *n > maxChoices {
+		return fmt.Errorf("n must be between 1 and %d, got %d", maxChoices, *n)
+	}
+	return nil
+}
+
+// choiceCount 返回请求的 choice 数量，未指定时为 1
+func (r *ChatCompletionRequest) choiceCount() int {
+	if r.N == nil {
+		return 1
+	}
+	return *r.N
+}
+
+// choiceResult 一个 choice 的完整输出
+type choiceResult struct {
+	Content      string
+	FinishReason string
+}
+
+// choiceSource 流式响应中一个 choice 的内容来源，Read 读取到的内容经过 Limiter 截断后发送，
+// 返回读取上游时出现的错误
+type choiceSource struct {
+	Limiter *outputLimiter
+	Read    func(emit func(string) bool) error
+}
+
+// choiceChunk 某个 choice 的一段输出；Done 为 true 表示该 choice 已结束，Tokens 为其输出的 token 数，
+// Err 不为空表示该 choice 读取出错而结束
+type choiceChunk struct {
+	Index   int
+	Content string
+	Done    bool
+	Tokens  int
+	Err     error
+}
+
+// readChoiceSources 并发读取所有 choice，按到达顺序汇总到同一个 channel，全部结束后关闭。
+// ctx 结束（客户端断开或处理函数已返回）后不再发送，读取的 goroutine 随之退出并关闭上游连接
+func readChoiceSources(ctx context.Context, sources []choiceSource) <-chan choiceChunk {
+	chunks := make(chan choiceChunk)
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(index int, src choiceSource) {
+			defer wg.Done()
+			var counter tokenCounter
+			deliver := func(chunk choiceChunk) bool {
+				select {
+				case chunks <- chunk:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			send := func(content string) bool {
+				if content == "" {
+					return true
+				}
+				counter.Add(content)
+				return deliver(choiceChunk{Index: index, Content: content})
+			}
+			stopped := false
+			err := src.Read(func(content string) bool {
+				out, done := src.Limiter.Feed(content)
+				if !send(out) {
+					stopped = true
+					return false
+				}
+				return !done
+			})
+			if stopped {
+				return
+			}
+			if err != nil {
+				deliver(choiceChunk{Index: index, Done: true, Err: err})
+				return
+			}
+			if !send(src.Limiter.Flush()) {
+				return
+			}
+			deliver(choiceChunk{Index: index, Done: true, Tokens: counter.Count()})
+		}(i, src)
+	}
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+	return chunks
+}
+
+// openStreams 并发发送 n 个相同的请求，任意一个失败时关闭其余事件流并返回错误
+func openStreams(ctx context.Context, req TalkAIRequest, n int) ([]EventStream, error) {
+	streams := make([]EventStream, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			streams[i], errs[i] = openStream(ctx, req)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, stream := range streams {
+				if stream != nil {
+					stream.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+// aggregateChoices 并发聚合每个事件流的完整内容，任意一个读取出错时返回其错误
+func aggregateChoices(streams []EventStream, stops []string, maxTokens int) ([]choiceResult, error) {
+	results := make([]choiceResult, len(streams))
+	errs := make([]error, len(streams))
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(i int, stream EventStream) {
+			defer wg.Done()
+			limiter := newOutputLimiter(stops, maxTokens)
+			content, err := aggregateStreamContent(stream, limiter)
+			results[i] = choiceResult{Content: content, FinishReason: limiter.FinishReason()}
+			errs[i] = err
+		}(i, stream)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// completeStructuredOutputs 并发生成 n 个经过校验的结构化输出，任意一个失败时返回其错误
+func completeStructuredOutputs(ctx context.Context, talkAIReq TalkAIRequest, f *ResponseFormat, tools *toolSettings, stops []string, maxTokens int, n int) ([]choiceResult, error) {
+	results := make([]choiceResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content, finishReason, err := completeStructuredOutput(ctx, talkAIReq, f, tools, stops, maxTokens)
+			results[i] = choiceResult{Content: content, FinishReason: finishReason}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CompletionPrompt prompt 参数，兼容字符串和字符串数组
+type CompletionPrompt []string
+
+// UnmarshalJSON 同时接受字符串和字符串数组，token 数组形式不受支持
+func (p *CompletionPrompt) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		*p = nil
+		return nil
+	}
+	if data[0] == '"' {
+		var single string
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*p = CompletionPrompt{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("prompt must be a string or an array of strings; token array prompts are not supported")
+	}
+	*p = list
+	return nil
+}
+
+// CompletionRequest /v1/completions 请求结构
+type CompletionRequest struct {
+	Model         string           `json:"model"`
+	Prompt        CompletionPrompt `json:"prompt"`
+	Suffix        string           `json:"suffix,omitempty"`
+	Echo          bool             `json:"echo,omitempty"`
+	Stop          StopSequences    `json:"stop,omitempty"`
+	MaxTokens     int              `json:"max_tokens,omitempty"`
+	Stream        bool             `json:"stream"`
+	StreamOptions *StreamOptions   `json:"stream_options,omitempty"`
+	Temperature   *float64         `json:"temperature,omitempty"`
+	User          string           `json:"user,omitempty"`
+}
+
+// CompletionChoice 文本补全选择结构
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// CompletionResponse 文本补全响应结构（流式分块使用同一结构）
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   map[string]int     `json:"usage,omitempty"`
+}
+
+// completionDefaultMaxTokens 与 OpenAI 旧版接口一致，未指定 max_tokens 时默认 16
+const completionDefaultMaxTokens = 16
+
+// maxCompletionPrompts prompt 数组的长度上限，每个 prompt 都对应一次上游请求
+const maxCompletionPrompts = 16
+
+// buildCompletionMessage 将 prompt 和 suffix 转换为单条 TalkAI 消息
+func buildCompletionMessage(prompt, suffix string) TalkAIMessage {
+	var b strings.Builder
+	b.WriteString("Continue the text below. Reply with the continuation only: do not repeat the given text, do not add any introduction, explanation or formatting.")
+	if suffix != "" {
+		b.WriteString(" The continuation will be followed directly by the text in <suffix>, so it must connect naturally to it; do not output the suffix itself.")
+	}
+	b.WriteString("\n\n<text>\n")
+	b.WriteString(prompt)
+	b.WriteString("\n</text>")
+	if suffix != "" {
+		b.WriteString("\n\n<suffix>\n")
+		b.WriteString(suffix)
+		b.WriteString("\n</suffix>")
+	}
+	return TalkAIMessage{
+		ID:      uuid.New().String(),
+		From:    "you",
+		Content: b.String(),
+	}
+}
+
+func completions(c *gin.Context) {
+	startTime := time.Now()
+
+	var req CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Prompt) == 0 {
+		req.Prompt = CompletionPrompt{""}
+	}
+	if len(req.Prompt) > maxCompletionPrompts {
+		writeAPIError(c, errInvalidRequest("prompt", "", fmt.Sprintf("prompt: at most %d prompts are allowed, got %d", maxCompletionPrompts, len(req.Prompt))))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	if len(req.Stop) > maxStopSequences {
+		writeAPIError(c, errInvalidRequest("stop", "", fmt.Sprintf("stop: at most %d stop sequences are allowed", maxStopSequences)))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 应用默认配置
+	if req.Model == "" {
+		req.Model = config.DefaultModel
+	}
+	if req.Temperature == nil {
+		req.Temperature = &config.DefaultTemp
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = completionDefaultMaxTokens
+	}
+	if c.Request.URL.Query().Get("stream") == "" && !req.Stream {
+		req.Stream = config.DefaultStream
+	}
+
+	// 每个 prompt 对应一次上游请求和一个 choice，先检查所有 prompt 的长度
+	promptTokens := 0
+	requests := make([]TalkAIRequest, 0, len(req.Prompt))
+	for _, prompt := range req.Prompt {
+		// 单条 prompt 无法截断，超过上下文窗口时直接返回错误
+		history, err := fitContext(c, []TalkAIMessage{buildCompletionMessage(prompt, req.Suffix)}, req.Model, req.MaxTokens)
+		if err != nil {
+			apiErr := upstreamAPIError(err)
+			if apiErr.Param == "messages" {
+				apiErr.Param = "prompt"
+			}
+			writeAPIError(c, apiErr)
+			trackRequest(c, startTime, apiErr.Status)
+			return
+		}
+		promptTokens += estimatePromptTokens(history)
+		requests = append(requests, TalkAIRequest{
+			Type:            "chat",
+			MessagesHistory: history,
+			Settings: map[string]interface{}{
+				"model":       req.Model,
+				"temperature": req.Temperature,
+			},
+		})
+	}
+
+	// 各个 choice 按顺序读取，上游请求在读取到对应的 choice 时才发送，避免同时占用多个连接。
+	// 第一个请求提前发送，失败时仍可以返回对应的状态码
+	first, err := openStream(c.Request.Context(), requests[0])
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAPIError(c, apiErr)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	defer first.Close()
+	open := func(i int) (EventStream, error) {
+		if i == 0 {
+			return first, nil
+		}
+		return openStream(c.Request.Context(), requests[i])
+	}
+
+	if req.Stream {
+		err = handleCompletionStream(c, open, &req, promptTokens)
+	} else {
+		err = handleCompletionResponse(c, open, &req, promptTokens)
+	}
+	if err != nil {
+		// 流式响应已经发送了错误分块
+		apiErr := upstreamAPIError(err)
+		if !req.Stream {
+			writeAPIError(c, apiErr)
+		}
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	trackRequest(c, startTime, http.StatusOK)
+}
+
+// handleCompletionResponse 读取上游出错时不写入响应，返回错误由调用方输出
+func handleCompletionResponse(c *gin.Context, open func(int) (EventStream, error), req *CompletionRequest, promptTokens int) error {
+	choices := make([]CompletionChoice, 0, len(req.Prompt))
+	completionTokens := 0
+	for i := range req.Prompt {
+		stream, err := open(i)
+		if err != nil {
+			return err
+		}
+		limiter := newOutputLimiter(req.Stop, req.MaxTokens)
+		var text strings.Builder
+		err = forEachStreamChunk(stream, func(chunk string) bool {
+			out, done := limiter.Feed(chunk)
+			text.WriteString(out)
+			return !done
+		})
+		if err != nil {
+			return err
+		}
+		text.WriteString(limiter.Flush())
+		completionTokens += estimateTokens(text.String())
+
+		choiceText := text.String()
+		if req.Echo {
+			choiceText = req.Prompt[i] + choiceText
+		}
+		finishReason := limiter.FinishReason()
+		choices = append(choices, CompletionChoice{
+			Text:         choiceText,
+			Index:        i,
+			FinishReason: &finishReason,
+		})
+	}
+
+	c.JSON(http.StatusOK, CompletionResponse{
+		ID:      fmt.Sprintf("cmpl-%s", uuid.New().String()),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: choices,
+		Usage:   usageMap(promptTokens, completionTokens),
+	})
+	return nil
+}
+
+// handleCompletionStream 请求或读取上游出错时发送 OpenAI 格式的错误分块并结束响应（不发送 [DONE]），返回该错误
+func handleCompletionStream(c *gin.Context, open func(int) (EventStream, error), req *CompletionRequest, promptTokens int) error {
+	// 设置流式响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	streamID := fmt.Sprintf("cmpl-%s", uuid.New().String())
+	createdTime := time.Now().Unix()
+
+	var streamErr error
+	c.Stream(func(w io.Writer) bool {
+		sendChoice := func(choice CompletionChoice) {
+			chunk := CompletionResponse{
+				ID:      streamID,
+				Object:  "text_completion",
+				Created: createdTime,
+				Model:   req.Model,
+				Choices: []CompletionChoice{choice},
+			}
+			jsonData, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+			w.(http.Flusher).Flush()
+		}
+
+		// 各个 choice 分开计数，避免一个 choice 末尾和下一个开头被算作同一个词
+		sendError := func(err error) {
+			streamErr = err
+			jsonData, _ := json.Marshal(apiErrorBody(upstreamAPIError(err)))
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+			w.(http.Flusher).Flush()
+		}
+
+		completionTokens := 0
+		for i := range req.Prompt {
+			var completion tokenCounter
+			if req.Echo && req.Prompt[i] != "" {
+				sendChoice(CompletionChoice{Text: req.Prompt[i], Index: i})
+			}
+
+			stream, err := open(i)
+			if err != nil {
+				sendError(err)
+				return false
+			}
+			limiter := newOutputLimiter(req.Stop, req.MaxTokens)
+			err = forEachStreamChunk(stream, func(chunk string) bool {
+				out, done := limiter.Feed(chunk)
+				if out != "" {
+					completion.Add(out)
+					sendChoice(CompletionChoice{Text: out, Index: i})
+				}
+				return !done
+			})
+			if err != nil {
+				sendError(err)
+				return false
+			}
+			if out := limiter.Flush(); out != "" {
+				completion.Add(out)
+				sendChoice(CompletionChoice{Text: out, Index: i})
+			}
+
+			finishReason := limiter.FinishReason()
+			sendChoice(CompletionChoice{Text: "", Index: i, FinishReason: &finishReason})
+			completionTokens += completion.Count()
+		}
+
+		if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+			usageChunk := CompletionResponse{
+				ID:      streamID,
+				Object:  "text_completion",
+				Created: createdTime,
+				Model:   req.Model,
+				Choices: []CompletionChoice{},
+				Usage:   usageMap(promptTokens, completionTokens),
+			}
+			jsonData, _ := json.Marshal(usageChunk)
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+		}
+
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		w.(http.Flusher).Flush()
+		return false
+	})
+	return streamErr
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// 上下文超长时的处理策略
+const (
+	// contextReject 返回 context_length_exceeded 错误（默认）
+	contextReject = "reject"
+	// contextTruncate 丢弃最早的对话轮次，保留系统提示和最近的轮次
+	contextTruncate = "truncate"
+	// contextSummarize 用模型总结中间的对话轮次，总结失败时退回 truncate
+	contextSummarize = "summarize"
+)
+
+// contextNotApplied 上下文没有超长时 X-Context-Strategy 的值
+const contextNotApplied = "none"
+
+// summaryPrompt 总结中间对话轮次时发送给模型的说明
+const summaryPrompt = "Summarize the following earlier part of a conversation between a user and an assistant. " +
+	"Keep every fact, decision, name, number and open question that later messages may rely on. " +
+	"Reply with the summary only.\n\n"
+
+// validContextStrategy 判断上下文策略名称是否有效
+func validContextStrategy(name string) bool {
+	switch name {
+	case contextReject, contextTruncate, contextSummarize:
+		return true
+	}
+	return false
+}
+
+// errContextLengthExceeded 与 OpenAI 相同的上下文超长错误
+func errContextLengthExceeded(window, promptTokens, maxOutput int) *APIError {
+	message := fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens", window, promptTokens)
+	if maxOutput > 0 {
+		message += fmt.Sprintf(" (%d in the messages, %d in the completion)", promptTokens, maxOutput)
+	}
+	return errInvalidRequest("messages", "context_length_exceeded", message+". Please reduce the length of the messages.")
+}
+
+// contextTurns 将消息历史按对话轮次分组，每轮从一条用户消息开始，包含之后的助手消息。
+// 返回每轮的起始位置，开头的助手消息单独成为一轮
+func contextTurns(history []TalkAIMessage) []int {
+	starts := []int{}
+	for i, msg := range history {
+		if i == 0 || msg.From == "you" {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// droppableTurns 按从旧到新的顺序选出需要移除的轮次，使剩余的消息估算不超过 budget。
+// 合并了系统提示的轮次和最后一轮不会被移除。返回被移除消息的标记和移除后的 token 数
+func droppableTurns(history []TalkAIMessage, budget int) ([]bool, int) {
+	starts := contextTurns(history)
+	dropped := make([]bool, len(history))
+	total := estimatePromptTokens(history)
+
+	for t := 0; t < len(starts)-1 && total > budget; t++ {
+		start, end := starts[t], starts[t+1]
+		pinned := false
+		for _, msg := range history[start:end] {
+			pinned = pinned || msg.system
+		}
+		if pinned {
+			continue
+		}
+		for i := start; i < end; i++ {
+			dropped[i] = true
+		}
+		total -= estimatePromptTokens(history[start:end])
+	}
+	return dropped, total
+}
+
+// summarizeTurns 请求模型总结被移除的消息，总结请求本身超长时只保留较新的部分
+func summarizeTurns(ctx context.Context, model string, removed []TalkAIMessage, window int) (string, error) {
+	lines := make([]string, 0, len(removed))
+	for _, msg := range removed {
+		speaker := "User"
+		if msg.From == "assistant" {
+			speaker = "Assistant"
+		}
+		lines = append(lines, speaker+": "+msg.Content)
+	}
+	for len(lines) > 1 && window > 0 && estimateTokens(summaryPrompt+strings.Join(lines, "\n\n")) > window/2 {
+		lines = lines[1:]
+	}
+
+	req := TalkAIRequest{
+		Type: "chat",
+		MessagesHistory: []TalkAIMessage{{
+			ID:      uuid.New().String(),
+			From:    "you",
+			Content: summaryPrompt + strings.Join(lines, "\n\n"),
+		}},
+		Settings: map[string]interface{}{
+			"model":       model,
+			"temperature": 0.2,
+		},
+	}
+	stream, err := openStream(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	var summary strings.Builder
+	err = forEachStreamChunk(stream, func(chunk string) bool {
+		summary.WriteString(chunk)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(summary.String()) == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
+
+// fitContext 检查消息历史的估算 token 数加上 maxOutput 是否超过模型的上下文窗口，
+// 超过时按模型的上下文策略处理，并通过 X-Context-Strategy 响应头报告实际采用的策略
+// （none、truncate 或 summarize），X-Context-Tokens 为处理后的估算 token 数。
+// 无法处理时返回 context_length_exceeded 错误
+func fitContext(c *gin.Context, history []TalkAIMessage, model string, maxOutput int) ([]TalkAIMessage, error) {
+	window, strategy := contextLimitFor(model)
+	total := estimatePromptTokens(history)
+	report := func(applied string, tokens int) {
+		c.Header("X-Context-Strategy", applied)
+		c.Header("X-Context-Tokens", strconv.Itoa(tokens))
+	}
+
+	budget := window - maxOutput
+	if window <= 0 || total <= budget {
+		report(contextNotApplied, total)
+		return history, nil
+	}
+	if strategy == contextReject || budget <= 0 {
+		return nil, errContextLengthExceeded(window, total, maxOutput)
+	}
+
+	dropped, remaining := droppableTurns(history, budget)
+	if remaining > budget {
+		return nil, errContextLengthExceeded(window, total, maxOutput)
+	}
+	kept := make([]TalkAIMessage, 0, len(history))
+	removed := []TalkAIMessage{}
+	for i, msg := range history {
+		if dropped[i] {
+			removed = append(removed, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+
+	if strategy == contextSummarize {
+		summary, err := summarizeTurns(c.Request.Context(), model, removed, window)
+		if err == nil {
+			if summarized, ok := insertSummary(history, dropped, summary, budget); ok {
+				tokens := estimatePromptTokens(summarized)
+				report(contextSummarize, tokens)
+				log.Printf("上下文超长（约 %d tokens，上限 %d），已总结 %d 条较早的消息", total, budget, len(removed))
+				return summarized, nil
+			}
+			err = fmt.Errorf("summary does not fit in the context window")
+		}
+		if c.Request.Context().Err() != nil {
+			return nil, c.Request.Context().Err()
+		}
+		log.Printf("总结较早的消息失败，改为直接丢弃: %v", err)
+	}
+
+	report(contextTruncate, remaining)
+	log.Printf("上下文超长（约 %d tokens，上限 %d），已丢弃 %d 条较早的消息", total, budget, len(removed))
+	return kept, nil
+}
+
+// insertSummary 用总结替换被移除的消息：总结合并到被移除部分之后的第一轮用户消息开头，
+// 避免出现连续的用户轮次。合并后仍然超长时返回 false
+func insertSummary(history []TalkAIMessage, dropped []bool, summary string, budget int) ([]TalkAIMessage, bool) {
+	result := make([]TalkAIMessage, 0, len(history))
+	pending := false
+	for i, msg := range history {
+		if dropped[i] {
+			pending = true
+			continue
+		}
+		if pending && msg.From == "you" {
+			msg.Content = "Summary of the earlier conversation:\n" + summary + "\n\n" + msg.Content
+			pending = false
+		}
+		result = append(result, msg)
+	}
+	if pending || estimatePromptTokens(result) > budget {
+		return nil, false
+	}
+	return result, true
+}
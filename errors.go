@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI 错误类型
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeAuthentication = "authentication_error"
+	errTypeRateLimit      = "rate_limit_error"
+	errTypeServer         = "server_error"
+)
+
+// APIError OpenAI 格式的错误，输出为 {"error": {"message", "type", "param", "code"}}。
+// Status 为返回给客户端的状态码，OpenAI SDK 据此决定是否重试（408、429 和 5xx 会重试）；
+// RetryAfter 大于 0 时同时输出 Retry-After 响应头
+type APIError struct {
+	Status     int
+	RetryAfter time.Duration
+	Message    string
+	Type       string
+	Param      string
+	Code       string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// errInvalidRequest 请求参数错误
+func errInvalidRequest(param, code, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Param: param, Code: code, Message: message}
+}
+
+// errNotFound 请求的资源不存在，OpenAI 对这类错误同样使用 invalid_request_error
+func errNotFound(param, code, message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Type: errTypeInvalidRequest, Param: param, Code: code, Message: message}
+}
+
+// errInvalidAPIKey 客户端密钥缺失或无效
+func errInvalidAPIKey(message string) *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "invalid_api_key", Message: message}
+}
+
+// errInternal 代理自身出错，与上游和请求内容无关
+func errInternal(message string) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Type: errTypeServer, Code: "internal_error", Message: message}
+}
+
+// requestAPIError 将请求校验错误转换为 APIError，ContentError 保留自己的 param 和 code，
+// 其他错误使用 param 指定的参数名
+func requestAPIError(err error, param string) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var contentErr *ContentError
+	if errors.As(err, &contentErr) {
+		return errInvalidRequest(contentErr.Param, contentErr.Code, contentErr.Message)
+	}
+	return errInvalidRequest(param, "", err.Error())
+}
+
+// upstreamAPIError 将 openStream、completeStructuredOutput 等返回的错误转换为 APIError，
+// 消息中保留上游的状态码和响应详情，方便排查
+func upstreamAPIError(err error) *APIError {
+	var apiErr *APIError
+	var statusErr *UpstreamStatusError
+	var openErr *CircuitOpenError
+	var accountsErr *AccountsUnavailableError
+	var outputErr *StructuredOutputError
+	var readErr *StreamReadError
+	var netErr net.Error
+	var urlErr *url.Error
+
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &statusErr):
+		return upstreamStatusAPIError(statusErr)
+	case errors.As(err, &openErr):
+		return &APIError{
+			Status:     http.StatusServiceUnavailable,
+			RetryAfter: openErr.RetryAfter,
+			Type:       errTypeServer,
+			Code:       "upstream_unavailable",
+			Message:    fmt.Sprintf("Upstream temporarily unavailable, please retry later (%v)", openErr),
+		}
+	case errors.As(err, &accountsErr):
+		return &APIError{
+			Status:     http.StatusServiceUnavailable,
+			RetryAfter: accountsErr.RetryAfter,
+			Type:       errTypeServer,
+			Code:       "upstream_accounts_unavailable",
+			Message:    fmt.Sprintf("Upstream temporarily unavailable, please retry later (%v)", accountsErr),
+		}
+	case errors.As(err, &outputErr):
+		return &APIError{
+			Status:  http.StatusBadGateway,
+			Type:    errTypeServer,
+			Param:   "response_format",
+			Code:    "invalid_structured_output",
+			Message: outputErr.Error(),
+		}
+	case errors.Is(err, context.Canceled):
+		return &APIError{Status: statusClientClosedRequest, Type: errTypeInvalidRequest, Code: "request_cancelled", Message: "Request was cancelled by the client"}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &APIError{Status: http.StatusGatewayTimeout, Type: errTypeServer, Code: "upstream_timeout", Message: fmt.Sprintf("Upstream request timed out: %v", err)}
+	case errors.As(err, &readErr):
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_stream_error", Message: readErr.Error()}
+	case errors.As(err, &urlErr), errors.As(err, &netErr):
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_connection_error", Message: fmt.Sprintf("Failed to connect to upstream: %v", err)}
+	}
+	return errInternal(fmt.Sprintf("Internal error: %v", err))
+}
+
+// upstreamStatusAPIError 按上游状态码映射错误。上游的 401/403 和验证页说明代理本身被拒绝，
+// 与客户端的密钥无关，因此返回 502 而不是原样透传
+func upstreamStatusAPIError(e *UpstreamStatusError) *APIError {
+	message := e.Error()
+	switch {
+	case e.Challenge:
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_challenge",
+			Message: "Upstream returned an anti-bot challenge page, " + message}
+	case e.StatusCode == http.StatusUnauthorized:
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_unauthorized", Message: message}
+	case e.StatusCode == http.StatusForbidden:
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_forbidden", Message: message}
+	case e.StatusCode == http.StatusTooManyRequests:
+		return &APIError{Status: http.StatusTooManyRequests, RetryAfter: e.RetryAfter, Type: errTypeRateLimit, Code: "rate_limit_exceeded", Message: message}
+	case e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusGatewayTimeout:
+		return &APIError{Status: http.StatusGatewayTimeout, Type: errTypeServer, Code: "upstream_timeout", Message: message}
+	case e.StatusCode >= 500:
+		return &APIError{Status: http.StatusBadGateway, Type: errTypeServer, Code: "upstream_error", Message: message}
+	}
+	return &APIError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Code: "upstream_rejected", Message: message}
+}
+
+// nullableString 空字符串输出为 JSON null
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// writeAPIError 按 OpenAI 格式输出错误
+func writeAPIError(c *gin.Context, e *APIError) {
+	if e.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int((e.RetryAfter+time.Second-1)/time.Second)))
+	}
+	c.JSON(e.Status, apiErrorBody(e))
+}
+
+// apiErrorBody OpenAI 格式的错误响应体。流式响应已经开始后出错时，作为最后一个数据块发送
+func apiErrorBody(e *APIError) gin.H {
+	return gin.H{"error": gin.H{
+		"message": e.Message,
+		"type":    e.Type,
+		"param":   nullableString(e.Param),
+		"code":    nullableString(e.Code),
+	}}
+}
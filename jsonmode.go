@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ResponseFormat 请求中的 response_format 字段
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat json_schema 模式下的 schema 定义
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// StructuredOutputError 多次重试后模型输出仍不符合要求的 JSON 格式
+type StructuredOutputError struct {
+	Attempts int
+	Problems []string
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("Model output did not satisfy response_format after %d attempt(s): %s", e.Attempts, strings.Join(e.Problems, "; "))
+}
+
+// jsonMode 是否要求模型输出 JSON
+func (f *ResponseFormat) jsonMode() bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+// validateResponseFormat 校验 response_format 参数
+func validateResponseFormat(f *ResponseFormat) error {
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case "", "text", "json_object":
+		return nil
+	case "json_schema":
+		if f.JSONSchema == nil {
+			return fmt.Errorf("response_format.json_schema is required when type is 'json_schema'")
+		}
+		if f.JSONSchema.Name == "" {
+			return fmt.Errorf("response_format.json_schema.name is required")
+		}
+		if len(bytes.TrimSpace(f.JSONSchema.Schema)) > 0 {
+			if _, err := validateJSONSchema(f.JSONSchema.Schema, nil); err != nil {
+				return fmt.Errorf("response_format.json_schema.schema: %v", err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("response_format.type: invalid value '%s'", f.Type)
+}
+
+// buildResponseFormatPrompt 构造引导模型输出 JSON 的提示
+func buildResponseFormatPrompt(f *ResponseFormat) string {
+	if !f.jsonMode() {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("Respond with a single valid JSON value only. Do not wrap it in markdown code fences and do not add any explanation before or after it.")
+	if f.Type == "json_object" {
+		b.WriteString(" The top-level value must be a JSON object.")
+		return b.String()
+	}
+
+	if f.JSONSchema.Description != "" {
+		fmt.Fprintf(&b, "\nThe JSON describes: %s", f.JSONSchema.Description)
+	}
+	if schema := bytes.TrimSpace(f.JSONSchema.Schema); len(schema) > 0 {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, schema); err == nil {
+			schema = compact.Bytes()
+		}
+		fmt.Fprintf(&b, "\nThe JSON must conform to this JSON Schema (named \"%s\"):\n%s", f.JSONSchema.Name, schema)
+	}
+	return b.String()
+}
+
+// extractJSON 从模型输出中提取 JSON，能修复代码块包裹、前后多余文字和尾随逗号
+func extractJSON(text string) (string, interface{}, error) {
+	candidate := strings.TrimSpace(text)
+
+	// 去掉 ```json ... ``` 代码块
+	if strings.HasPrefix(candidate, "```") {
+		candidate = strings.TrimPrefix(candidate, "```")
+		if nl := strings.Index(candidate, "\n"); nl >= 0 {
+			candidate = candidate[nl+1:]
+		}
+		candidate = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(candidate), "```"))
+	}
+
+	var value interface{}
+	err := json.Unmarshal([]byte(candidate), &value)
+	if err == nil {
+		return candidate, value, nil
+	}
+
+	// 截取第一个完整的对象或数组
+	if span := balancedJSONSpan(candidate); span != "" {
+		if json.Unmarshal([]byte(span), &value) == nil {
+			return span, value, nil
+		}
+		repaired := removeTrailingCommas(span)
+		if json.Unmarshal([]byte(repaired), &value) == nil {
+			return repaired, value, nil
+		}
+	}
+	return "", nil, err
+}
+
+// balancedJSONSpan 返回文本中第一个括号配平的 {...} 或 [...] 片段
+func balancedJSONSpan(text string) string {
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return ""
+	}
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return text[start : i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// removeTrailingCommas 去掉 } 或 ] 之前多余的逗号
+func removeTrailingCommas(text string) string {
+	var b strings.Builder
+	inString := false
+	escaped := false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if inString {
+			b.WriteByte(ch)
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		if ch == '"' {
+			inString = true
+		}
+		if ch == ',' {
+			rest := strings.TrimLeft(text[i+1:], " \t\r\n")
+			if strings.HasPrefix(rest, "}") || strings.HasPrefix(rest, "]") {
+				continue
+			}
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+// checkStructuredOutput 校验并修复模型输出，返回规范后的 JSON 文本和问题列表
+func checkStructuredOutput(text string, f *ResponseFormat) (string, []string) {
+	jsonText, value, err := extractJSON(text)
+	if err != nil {
+		return "", []string{fmt.Sprintf("output is not valid JSON (%v)", err)}
+	}
+
+	if f.Type == "json_object" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", []string{fmt.Sprintf("top-level value must be an object, got %s", jsonTypeName(value))}
+		}
+		return jsonText, nil
+	}
+
+	if schema := bytes.TrimSpace(f.JSONSchema.Schema); len(schema) > 0 {
+		problems, err := validateJSONSchema(schema, value)
+		if err != nil {
+			return "", []string{err.Error()}
+		}
+		if len(problems) > 0 {
+			return "", problems
+		}
+	}
+	return jsonText, nil
+}
+
+// maxRepairTokens 重试时追加到历史中的不合格输出和错误说明各自的最大 token 数
+const maxRepairTokens = 2048
+
+// truncateForRepair 将重试时回传给模型的文本截断到 maxRepairTokens
+func truncateForRepair(text string) string {
+	truncated := truncateToTokens(tokenCounter{}, text, maxRepairTokens)
+	if len(truncated) < len(text) {
+		truncated += "\n[truncated]"
+	}
+	return truncated
+}
+
+// completeStructuredOutput 请求上游并校验 JSON 输出，不合格时带着错误信息让模型重试，
+// 最多重试 JSON_MODE_MAX_RETRIES 次。返回内容和结束原因；因 max_tokens 截断的输出原样返回，不做校验
+func completeStructuredOutput(ctx context.Context, talkAIReq TalkAIRequest, f *ResponseFormat, tools *toolSettings, stops []string, maxTokens int) (string, string, error) {
+	attempts := config.JSONModeMaxRetries + 1
+	model, _ := talkAIReq.Settings["model"].(string)
+	window, _ := contextLimitFor(model)
+	var problems []string
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		stream, err := openStream(ctx, talkAIReq)
+		if err != nil {
+			return "", "", err
+		}
+		// 有回复开头时校验开头和续写拼接后的完整输出
+		limiter := newOutputLimiter(stops, maxTokens)
+		output, err := aggregateStreamContent(stream, limiter)
+		if err != nil {
+			return "", "", err
+		}
+		content := talkAIReq.prefill + output
+
+		// 输出被截断时无法保证是完整的 JSON，与 OpenAI 一致直接返回
+		if limiter.FinishReason() == "length" {
+			return content, "length", nil
+		}
+
+		// 模型选择调用工具时不做 JSON 校验
+		if tools.enabled() {
+			if _, calls := parseToolCalls(content, tools); len(calls) > 0 {
+				return content, "stop", nil
+			}
+		}
+
+		var jsonText string
+		jsonText, problems = checkStructuredOutput(content, f)
+		if len(problems) == 0 {
+			return jsonText, "stop", nil
+		}
+
+		if config.DebugMode {
+			log.Printf("结构化输出第 %d 次校验失败: %s", attempt, strings.Join(problems, "; "))
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		// 把不合格的输出和错误说明追加到历史中，让模型修正。两者都截断到 maxRepairTokens，
+		// 避免每次重试都让历史成倍增长。
+		// 限制容量使 append 总是复制，n > 1 时并发的请求共享同一个历史切片
+		history := talkAIReq.MessagesHistory
+		history = append(history[:len(history):len(history)],
+			TalkAIMessage{ID: uuid.New().String(), From: "assistant", Content: truncateForRepair(content)},
+			TalkAIMessage{
+				ID:   uuid.New().String(),
+				From: "you",
+				Content: "Your previous reply did not satisfy the required JSON format:\n- " + truncateForRepair(strings.Join(problems, "\n- ")) +
+					"\nReply again with only the corrected JSON and nothing else.",
+			},
+		)
+		// 追加后超出上下文窗口时不再重试，直接报告校验失败
+		if window > 0 && estimatePromptTokens(history)+maxTokens > window {
+			if config.DebugMode {
+				log.Printf("结构化输出重试会超出上下文窗口（%d tokens），停止重试", window)
+			}
+			return "", "", &StructuredOutputError{Attempts: attempt, Problems: problems}
+		}
+		talkAIReq.MessagesHistory = history
+	}
+
+	return "", "", &StructuredOutputError{Attempts: attempts, Problems: problems}
+}
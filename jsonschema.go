@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchemaValidator 结构化输出使用的 JSON Schema 子集校验器，
+// 支持 type、properties、required、additionalProperties、items、enum、const、
+// 长度与数值范围、pattern、anyOf/oneOf/allOf 以及 $defs / definitions 内的 $ref
+type jsonSchemaValidator struct {
+	root   map[string]interface{}
+	errors []string
+	// steps 本次校验已访问的 schema 节点数，anyOf/oneOf 的子校验共用同一个计数
+	steps *int
+}
+
+const (
+	// maxSchemaErrors 单次校验最多收集的错误数量
+	maxSchemaErrors = 10
+	// maxSchemaSteps 单次校验最多访问的 schema 节点数。anyOf/oneOf 与 $ref 组合时校验量可能随嵌套层数指数增长，
+	// 超过上限时放弃校验
+	maxSchemaSteps = 100000
+)
+
+// validateJSONSchema 校验 value 是否满足 schema，返回可读的错误列表
+func validateJSONSchema(schema json.RawMessage, value interface{}) ([]string, error) {
+	var root interface{}
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %v", err)
+	}
+	rootMap, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid JSON schema: schema must be an object")
+	}
+
+	if err := checkSchemaRefCycles(rootMap); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %v", err)
+	}
+
+	steps := 0
+	v := &jsonSchemaValidator{root: rootMap, steps: &steps}
+	v.validate(rootMap, value, "$", 0)
+	if steps > maxSchemaSteps {
+		return nil, fmt.Errorf("JSON schema is too complex to validate (more than %d steps)", maxSchemaSteps)
+	}
+	return v.errors, nil
+}
+
+// checkSchemaRefCycles 检查不消耗数据的 $ref 循环：只经过 $ref、allOf、anyOf、oneOf 就回到自身的 schema
+// 会在同一个值上无限递归，例如 {"anyOf": [{"$ref": "#"}]}。经过 properties、items 等的循环每层都会深入一级数据，不受影响
+func checkSchemaRefCycles(root map[string]interface{}) error {
+	v := &jsonSchemaValidator{root: root}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[uintptr]int)
+
+	var visit func(s map[string]interface{}, where string) error
+	visit = func(s map[string]interface{}, where string) error {
+		id := reflect.ValueOf(s).Pointer()
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("$ref cycle at %s does not consume any data", where)
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		if ref, ok := s["$ref"].(string); ok {
+			if target, found := v.resolve(ref); found {
+				if err := visit(target, ref); err != nil {
+					return err
+				}
+			}
+		}
+		for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+			list, _ := s[keyword].([]interface{})
+			for i, item := range list {
+				if sub, ok := item.(map[string]interface{}); ok {
+					if err := visit(sub, fmt.Sprintf("%s/%s/%d", where, keyword, i)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		state[id] = done
+		return nil
+	}
+
+	// 从 schema 中的每个对象出发检查，enum 和 const 中是数据而不是 schema
+	var walk func(node interface{}, where string) error
+	walk = func(node interface{}, where string) error {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if err := visit(n, where); err != nil {
+				return err
+			}
+			for key, child := range n {
+				if key == "enum" || key == "const" {
+					continue
+				}
+				if err := walk(child, where+"/"+key); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, child := range n {
+				if err := walk(child, fmt.Sprintf("%s/%d", where, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(root, "#")
+}
+
+func (v *jsonSchemaValidator) fail(path, format string, args ...interface{}) {
+	if len(v.errors) < maxSchemaErrors {
+		v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *jsonSchemaValidator) resolve(ref string) (map[string]interface{}, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		node = m[part]
+	}
+	m, ok := node.(map[string]interface{})
+	return m, ok
+}
+
+// sub 对子 schema 单独校验，返回是否通过（不记录错误）
+func (v *jsonSchemaValidator) sub(schema interface{}, value interface{}, path string, depth int) bool {
+	child := &jsonSchemaValidator{root: v.root, steps: v.steps}
+	child.validate(schema, value, path, depth)
+	return len(child.errors) == 0
+}
+
+func (v *jsonSchemaValidator) validate(schemaNode interface{}, value interface{}, path string, depth int) {
+	if depth > 64 {
+		v.fail(path, "schema nesting too deep")
+		return
+	}
+	if *v.steps++; *v.steps > maxSchemaSteps {
+		v.fail(path, "schema too complex to validate")
+		return
+	}
+	switch s := schemaNode.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "no value is allowed here")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObjectSchema(s, value, path, depth)
+	}
+}
+
+func (v *jsonSchemaValidator) validateObjectSchema(s map[string]interface{}, value interface{}, path string, depth int) {
+	// OpenAPI 风格的 nullable 允许 null，优先于 type 和 $ref 的检查
+	if nullable, _ := s["nullable"].(bool); nullable && value == nil {
+		return
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		target, found := v.resolve(ref)
+		if !found {
+			v.fail(path, "unresolvable $ref %q", ref)
+			return
+		}
+		v.validate(target, value, path, depth+1)
+	}
+
+	if t, ok := s["type"]; ok && !matchesSchemaType(t, value) {
+		v.fail(path, "expected %s, got %s", describeSchemaType(t), jsonTypeName(value))
+		return
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		matched := false
+		for _, candidate := range enum {
+			if jsonEqual(candidate, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "value is not one of the allowed enum values")
+		}
+	}
+	if constant, ok := s["const"]; ok && !jsonEqual(constant, value) {
+		v.fail(path, "value does not match const")
+	}
+
+	switch val := value.(type) {
+	case string:
+		length := float64(utf8.RuneCountInString(val))
+		if min, ok := s["minLength"].(float64); ok && length < min {
+			v.fail(path, "string shorter than minLength %v", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && length > max {
+			v.fail(path, "string longer than maxLength %v", max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(val) {
+				v.fail(path, "string does not match pattern %q", pattern)
+			}
+		}
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && val < min {
+			v.fail(path, "number less than minimum %v", min)
+		}
+		if max, ok := s["maximum"].(float64); ok && val > max {
+			v.fail(path, "number greater than maximum %v", max)
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && val <= min {
+			v.fail(path, "number not greater than exclusiveMinimum %v", min)
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && val >= max {
+			v.fail(path, "number not less than exclusiveMaximum %v", max)
+		}
+	case []interface{}:
+		if min, ok := s["minItems"].(float64); ok && float64(len(val)) < min {
+			v.fail(path, "array has fewer than minItems %v", min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && float64(len(val)) > max {
+			v.fail(path, "array has more than maxItems %v", max)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth+1)
+			}
+		}
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, present := val[name]; !present {
+						v.fail(path, "missing required property %q", name)
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path + "." + k
+			if propSchema, ok := props[k]; ok {
+				v.validate(propSchema, val[k], childPath, depth+1)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					v.fail(path, "unexpected property %q", k)
+				}
+			case map[string]interface{}:
+				v.validate(extra, val[k], childPath, depth+1)
+			}
+		}
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path, depth+1)
+		}
+	}
+	if any, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range any {
+			if v.sub(sub, value, path, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "value does not match any schema in anyOf")
+		}
+	}
+	if one, ok := s["oneOf"].([]interface{}); ok {
+		count := 0
+		for _, sub := range one {
+			if v.sub(sub, value, path, depth+1) {
+				count++
+			}
+		}
+		if count != 1 {
+			v.fail(path, "value must match exactly one schema in oneOf (matched %d)", count)
+		}
+	}
+}
+
+func matchesSchemaType(t interface{}, value interface{}) bool {
+	switch tt := t.(type) {
+	case string:
+		return matchesTypeName(tt, value)
+	case []interface{}:
+		for _, candidate := range tt {
+			if name, ok := candidate.(string); ok && matchesTypeName(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == name
+	}
+}
+
+func describeSchemaType(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, item := range list {
+			names = append(names, fmt.Sprint(item))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
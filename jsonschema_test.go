@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateJSONSchemaRefCycle(t *testing.T) {
+	schemas := []string{
+		`{"anyOf":[{"$ref":"#"},{"$ref":"#"}]}`,
+		`{"$ref":"#"}`,
+		`{"$defs":{"a":{"allOf":[{"$ref":"#/$defs/b"}]},"b":{"oneOf":[{"$ref":"#/$defs/a"}]}},"properties":{"x":{"$ref":"#/$defs/a"}}}`,
+	}
+	for _, schema := range schemas {
+		done := make(chan error, 1)
+		go func() {
+			_, err := validateJSONSchema(json.RawMessage(schema), nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "$ref cycle") {
+				t.Errorf("validateJSONSchema(%s) error = %v, want $ref cycle error", schema, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("validateJSONSchema(%s) did not return", schema)
+		}
+	}
+}
+
+func TestValidateJSONSchemaRecursiveData(t *testing.T) {
+	// 经过 properties 的递归是合法的
+	schema := `{"type":"object","properties":{"name":{"type":"string"},"children":{"type":"array","items":{"$ref":"#"}}},"required":["name"]}`
+	value := map[string]interface{}{
+		"name":     "root",
+		"children": []interface{}{map[string]interface{}{"name": "child", "children": []interface{}{map[string]interface{}{}}}},
+	}
+	problems, err := validateJSONSchema(json.RawMessage(schema), value)
+	if err != nil {
+		t.Fatalf("validateJSONSchema() error = %v", err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], `missing required property "name"`) {
+		t.Errorf("problems = %q, want one missing name", problems)
+	}
+}
+
+func TestValidateJSONSchemaStepBudget(t *testing.T) {
+	// 每层两个分支都会深入下一层，不限制时校验量为 2^40
+	schema := `{"$defs":{"n":{"anyOf":[
+		{"type":"object","required":["missing"],"properties":{"a":{"$ref":"#/$defs/n"}}},
+		{"type":"object","required":["missing"],"properties":{"a":{"$ref":"#/$defs/n"}}}
+	]}},"$ref":"#/$defs/n"}`
+	var value interface{} = map[string]interface{}{}
+	for i := 0; i < 40; i++ {
+		value = map[string]interface{}{"a": value}
+	}
+
+	start := time.Now()
+	_, err := validateJSONSchema(json.RawMessage(schema), value)
+	if err == nil || !strings.Contains(err.Error(), "too complex") {
+		t.Errorf("validateJSONSchema() error = %v, want too complex error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("validateJSONSchema() took %v", elapsed)
+	}
+}
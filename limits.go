@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxStopSequences 与 OpenAI 一致，最多 4 个停止序列
+const maxStopSequences = 4
+
+// StopSequences stop 参数，兼容字符串和字符串数组两种格式
+type StopSequences []string
+
+// UnmarshalJSON 同时接受字符串、字符串数组和 null
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		*s = nil
+		return nil
+	}
+	if data[0] == '"' {
+		var single string
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*s = StopSequences{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = list
+	return nil
+}
+
+// validateOutputLimits 检查 stop 和 max_tokens 参数
+func validateOutputLimits(stop StopSequences, maxTokens ...*int) error {
+	if len(stop) > maxStopSequences {
+		return fmt.Errorf("stop: at most %d stop sequences are allowed", maxStopSequences)
+	}
+	for _, n := range maxTokens {
+		if n != nil && *n < 1 {
+			return fmt.Errorf("max_tokens must be at least 1, got %d", *n)
+		}
+	}
+	return nil
+}
+
+// maxOutputTokens 返回请求的输出 token 上限，max_completion_tokens 优先，未指定时为 0（不限制）
+func (r *ChatCompletionRequest) maxOutputTokens() int {
+	if r.MaxCompletionTokens != nil {
+		return *r.MaxCompletionTokens
+	}
+	if r.MaxTokens != nil {
+		return *r.MaxTokens
+	}
+	return 0
+}
+
+// outputLimiter 在代理侧执行停止序列和 max_tokens 限制。
+// 停止序列可能跨越多个上游分块，因此末尾可能构成停止序列前缀的内容会先缓存
+type outputLimiter struct {
+	stops     []string
+	maxTokens int
+	pending   string
+	counter   tokenCounter
+	done      bool
+	reason    string
+	matched   string
+}
+
+func newOutputLimiter(stops []string, maxTokens int) *outputLimiter {
+	l := &outputLimiter{maxTokens: maxTokens, reason: "stop"}
+	for _, stop := range stops {
+		if stop != "" {
+			l.stops = append(l.stops, stop)
+		}
+	}
+	return l
+}
+
+// passthroughLimiter 返回不做任何截断、结束原因固定为 reason 的限制器，用于已经截断过的完整输出
+func passthroughLimiter(reason string) *outputLimiter {
+	return &outputLimiter{reason: reason}
+}
+
+// Feed 输入一段上游输出，返回可以下发的内容以及是否已经到达限制
+func (l *outputLimiter) Feed(chunk string) (string, bool) {
+	if l.done {
+		return "", true
+	}
+	l.pending += chunk
+
+	// 查找最早出现的停止序列
+	cut := -1
+	for _, stop := range l.stops {
+		if idx := strings.Index(l.pending, stop); idx >= 0 && (cut < 0 || idx < cut) {
+			cut = idx
+			l.matched = stop
+		}
+	}
+	if cut >= 0 {
+		out := l.pending[:cut]
+		l.pending = ""
+		l.done = true
+		return l.applyBudget(out), true
+	}
+
+	keep := 0
+	for _, stop := range l.stops {
+		if n := partialSuffixLen(l.pending, stop); n > keep {
+			keep = n
+		}
+	}
+	out := l.pending[:len(l.pending)-keep]
+	l.pending = l.pending[len(l.pending)-keep:]
+	return l.applyBudget(out), l.done
+}
+
+// Flush 上游输出结束时返回缓存中剩余的内容
+func (l *outputLimiter) Flush() string {
+	if l.done {
+		return ""
+	}
+	out := l.pending
+	l.pending = ""
+	return l.applyBudget(out)
+}
+
+// FinishReason 返回 "stop" 或 "length"
+func (l *outputLimiter) FinishReason() string {
+	return l.reason
+}
+
+// StopSequence 返回命中的停止序列，未命中时为空
+func (l *outputLimiter) StopSequence() string {
+	if l.reason != "stop" {
+		return ""
+	}
+	return l.matched
+}
+
+func (l *outputLimiter) applyBudget(out string) string {
+	if l.maxTokens <= 0 || out == "" {
+		return out
+	}
+	counter := l.counter
+	counter.Add(out)
+	if counter.Count() <= l.maxTokens {
+		l.counter = counter
+		return out
+	}
+	out = truncateToTokens(l.counter, out, l.maxTokens)
+	l.counter.Add(out)
+	l.done = true
+	l.reason = "length"
+	l.matched = ""
+	l.pending = ""
+	return out
+}
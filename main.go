@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,16 +19,38 @@ import (
 
 // ChatMessage 聊天消息结构
 type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string         `json:"role"`
+	Content      MessageContent `json:"content"`
+	Name         string         `json:"name,omitempty"`
+	ToolCalls    []ToolCall     `json:"tool_calls,omitempty"`
+	ToolCallID   string         `json:"tool_call_id,omitempty"`
+	FunctionCall *FunctionCall  `json:"function_call,omitempty"`
 }
 
 // ChatCompletionRequest 聊天完成请求结构
 type ChatCompletionRequest struct {
-	Model       string         `json:"model"`
-	Messages    []ChatMessage  `json:"messages"`
-	Stream      bool           `json:"stream"`
-	Temperature *float64       `json:"temperature,omitempty"`
+	Model               string               `json:"model"`
+	Messages            []ChatMessage        `json:"messages"`
+	Stream              bool                 `json:"stream"`
+	Temperature         *float64             `json:"temperature,omitempty"`
+	Tools               []Tool               `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage      `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                `json:"parallel_tool_calls,omitempty"`
+	Functions           []FunctionDefinition `json:"functions,omitempty"`
+	FunctionCall        json.RawMessage      `json:"function_call,omitempty"`
+	ResponseFormat      *ResponseFormat      `json:"response_format,omitempty"`
+	Stop                StopSequences        `json:"stop,omitempty"`
+	MaxTokens           *int                 `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int                 `json:"max_completion_tokens,omitempty"`
+	StreamOptions       *StreamOptions       `json:"stream_options,omitempty"`
+	N                   *int                 `json:"n,omitempty"`
+	PromptTemplate      *PromptTemplateRef   `json:"prompt_template,omitempty"`
+	IncludePrefill      *bool                `json:"include_prefill,omitempty"`
+}
+
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // ModelInfo 模型信息结构
@@ -76,6 +98,7 @@ type StreamResponse struct {
 	Created int64         `json:"created"`
 	Model   string        `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   map[string]int `json:"usage,omitempty"`
 }
 
 // TalkAIMessage TalkAI 消息结构
@@ -83,6 +106,9 @@ type TalkAIMessage struct {
 	ID      string `json:"id"`
 	From    string `json:"from"`
 	Content string `json:"content"`
+
+	// system 表示系统提示合并在这条消息中，截断历史时保留
+	system bool
 }
 
 // TalkAIRequest TalkAI 请求结构
@@ -90,6 +116,9 @@ type TalkAIRequest struct {
 	Type            string         `json:"type"`
 	MessagesHistory []TalkAIMessage `json:"messagesHistory"`
 	Settings        map[string]interface{} `json:"settings"`
+
+	// prefill 回复已经写好的开头，模型重复开头时从输出中去掉
+	prefill string
 }
 
 // Config 应用配置结构
@@ -102,6 +131,31 @@ type Config struct {
 	Timeout         int      `env:"TIMEOUT" envDefault:"300"`
 	DebugMode       bool     `env:"DEBUG_MODE" envDefault:"false"`
 	DashboardEnabled bool     `env:"DASHBOARD_ENABLED" envDefault:"true"`
+	JSONModeMaxRetries int    `env:"JSON_MODE_MAX_RETRIES" envDefault:"2"`
+	OllamaAuth      bool     `env:"OLLAMA_AUTH" envDefault:"true"`
+	UpstreamBaseURL string   `env:"UPSTREAM_BASE_URL" envDefault:"https://claude.talkai.info"`
+	UpstreamHeaders map[string]string `env:"UPSTREAM_HEADERS" envDefault:""`
+	UpstreamProxies []string `env:"UPSTREAM_PROXY" envDefault:""`
+	UpstreamMaxIdleConnsPerHost int `env:"UPSTREAM_MAX_IDLE_CONNS_PER_HOST" envDefault:"32"`
+	UpstreamIdleConnTimeout int `env:"UPSTREAM_IDLE_CONN_TIMEOUT" envDefault:"90"`
+	UpstreamTLSHandshakeTimeout int `env:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT" envDefault:"10"`
+	UpstreamHTTP2   bool     `env:"UPSTREAM_HTTP2" envDefault:"true"`
+	UpstreamKeepAlive int    `env:"UPSTREAM_KEEPALIVE" envDefault:"30"`
+	UpstreamMaxRetries int   `env:"UPSTREAM_MAX_RETRIES" envDefault:"2"`
+	UpstreamRetryBaseDelay int `env:"UPSTREAM_RETRY_BASE_DELAY" envDefault:"500"`
+	UpstreamRetryMaxDelay int `env:"UPSTREAM_RETRY_MAX_DELAY" envDefault:"10000"`
+	BreakerFailureThreshold int `env:"BREAKER_FAILURE_THRESHOLD" envDefault:"5"`
+	BreakerOpenSeconds int   `env:"BREAKER_OPEN_SECONDS" envDefault:"30"`
+	UpstreamBalance string   `env:"UPSTREAM_BALANCE" envDefault:"weighted"`
+	AccountCooldown int      `env:"ACCOUNT_COOLDOWN" envDefault:"60"`
+	AccountQuarantine int    `env:"ACCOUNT_QUARANTINE" envDefault:"1800"`
+	AdminKey        string   `env:"ADMIN_KEY" envDefault:""`
+	SystemStrategy  string   `env:"SYSTEM_STRATEGY" envDefault:"last_user"`
+	ContextWindow   int      `env:"CONTEXT_WINDOW" envDefault:"200000"`
+	ContextStrategy string   `env:"CONTEXT_STRATEGY" envDefault:"reject"`
+	PrefillInclude  bool     `env:"PREFILL_INCLUDE" envDefault:"false"`
+	RoleMap         map[string]string `env:"ROLE_MAP" envDefault:""`
+	NameLabels      bool     `env:"NAME_LABELS" envDefault:"true"`
 }
 
 // 请求统计信息
@@ -109,6 +163,8 @@ type RequestStats struct {
 	TotalRequests       int64         `json:"total_requests"`
 	SuccessfulRequests  int64         `json:"successful_requests"`
 	FailedRequests      int64         `json:"failed_requests"`
+	ClientCancelledRequests int64     `json:"client_cancelled_requests"`
+	UpstreamRetries     int64         `json:"upstream_retries"`
 	LastRequestTime     time.Time     `json:"last_request_time"`
 	AverageResponseTime  time.Duration `json:"average_response_time"`
 }
@@ -122,6 +178,31 @@ type LiveRequest struct {
 	Status    int       `json:"status"`
 	Duration  int64     `json:"duration"`
 	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Retries   int       `json:"retries"`
+	Template  string    `json:"template,omitempty"`
+}
+
+// statusClientClosedRequest 客户端在响应完成前断开连接（与 nginx 的 499 含义相同）
+const statusClientClosedRequest = 499
+
+// 请求结果
+const (
+	outcomeSuccess         = "success"
+	outcomeError           = "error"
+	outcomeClientCancelled = "client_cancelled"
+)
+
+// requestOutcome 根据状态码判断请求结果
+func requestOutcome(status int) string {
+	switch {
+	case status == statusClientClosedRequest:
+		return outcomeClientCancelled
+	case status >= 200 && status < 300:
+		return outcomeSuccess
+	default:
+		return outcomeError
+	}
 }
 
 var (
@@ -145,6 +226,26 @@ func loadConfig() {
 		Timeout:         300,
 		DebugMode:       false,
 		DashboardEnabled: true,
+		JSONModeMaxRetries: 2,
+		OllamaAuth:      true,
+		UpstreamBaseURL: "https://claude.talkai.info",
+		UpstreamMaxIdleConnsPerHost: 32,
+		UpstreamIdleConnTimeout: 90,
+		UpstreamTLSHandshakeTimeout: 10,
+		UpstreamHTTP2:   true,
+		UpstreamKeepAlive: 30,
+		UpstreamMaxRetries: 2,
+		UpstreamRetryBaseDelay: 500,
+		UpstreamRetryMaxDelay: 10000,
+		BreakerFailureThreshold: 5,
+		BreakerOpenSeconds: 30,
+		UpstreamBalance: balanceWeighted,
+		AccountCooldown: 60,
+		AccountQuarantine: 1800,
+		SystemStrategy:  systemLastUser,
+		ContextWindow:   200000,
+		ContextStrategy: contextReject,
+		NameLabels:      true,
 	}
 
 	// 从环境变量读取配置
@@ -195,12 +296,175 @@ func loadConfig() {
 			config.DashboardEnabled = b
 		}
 	}
+
+	if jsonRetries := os.Getenv("JSON_MODE_MAX_RETRIES"); jsonRetries != "" {
+		if n, err := strconv.Atoi(jsonRetries); err == nil && n >= 0 {
+			config.JSONModeMaxRetries = n
+		}
+	}
+
+	if ollamaAuth := os.Getenv("OLLAMA_AUTH"); ollamaAuth != "" {
+		if b, err := strconv.ParseBool(ollamaAuth); err == nil {
+			config.OllamaAuth = b
+		}
+	}
+
+	if baseURL := os.Getenv("UPSTREAM_BASE_URL"); baseURL != "" {
+		config.UpstreamBaseURL = baseURL
+	}
+
+	// 附加请求头为 JSON 对象，例如 {"User-Agent": "..."}，值为空字符串时删除该请求头
+	if headers := os.Getenv("UPSTREAM_HEADERS"); headers != "" {
+		if err := json.Unmarshal([]byte(headers), &config.UpstreamHeaders); err != nil {
+			log.Printf("解析 UPSTREAM_HEADERS 出错: %v", err)
+		}
+	}
+
+	if proxies := os.Getenv("UPSTREAM_PROXY"); proxies != "" {
+		config.UpstreamProxies = strings.Split(proxies, ",")
+	}
+
+	if maxIdle := os.Getenv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST"); maxIdle != "" {
+		if n, err := strconv.Atoi(maxIdle); err == nil && n > 0 {
+			config.UpstreamMaxIdleConnsPerHost = n
+		}
+	}
+
+	if idleTimeout := os.Getenv("UPSTREAM_IDLE_CONN_TIMEOUT"); idleTimeout != "" {
+		if n, err := strconv.Atoi(idleTimeout); err == nil && n >= 0 {
+			config.UpstreamIdleConnTimeout = n
+		}
+	}
+
+	if tlsTimeout := os.Getenv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT"); tlsTimeout != "" {
+		if n, err := strconv.Atoi(tlsTimeout); err == nil && n >= 0 {
+			config.UpstreamTLSHandshakeTimeout = n
+		}
+	}
+
+	if http2 := os.Getenv("UPSTREAM_HTTP2"); http2 != "" {
+		if b, err := strconv.ParseBool(http2); err == nil {
+			config.UpstreamHTTP2 = b
+		}
+	}
+
+	if keepAlive := os.Getenv("UPSTREAM_KEEPALIVE"); keepAlive != "" {
+		if n, err := strconv.Atoi(keepAlive); err == nil {
+			config.UpstreamKeepAlive = n
+		}
+	}
+
+	if maxRetries := os.Getenv("UPSTREAM_MAX_RETRIES"); maxRetries != "" {
+		if n, err := strconv.Atoi(maxRetries); err == nil && n >= 0 {
+			config.UpstreamMaxRetries = n
+		}
+	}
+
+	if baseDelay := os.Getenv("UPSTREAM_RETRY_BASE_DELAY"); baseDelay != "" {
+		if n, err := strconv.Atoi(baseDelay); err == nil && n >= 0 {
+			config.UpstreamRetryBaseDelay = n
+		}
+	}
+
+	if maxDelay := os.Getenv("UPSTREAM_RETRY_MAX_DELAY"); maxDelay != "" {
+		if n, err := strconv.Atoi(maxDelay); err == nil && n >= 0 {
+			config.UpstreamRetryMaxDelay = n
+		}
+	}
+
+	if threshold := os.Getenv("BREAKER_FAILURE_THRESHOLD"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err == nil && n >= 0 {
+			config.BreakerFailureThreshold = n
+		}
+	}
+
+	if openSeconds := os.Getenv("BREAKER_OPEN_SECONDS"); openSeconds != "" {
+		if n, err := strconv.Atoi(openSeconds); err == nil && n > 0 {
+			config.BreakerOpenSeconds = n
+		}
+	}
+
+	if balance := os.Getenv("UPSTREAM_BALANCE"); balance != "" {
+		if validBalanceStrategy(balance) {
+			config.UpstreamBalance = balance
+		} else {
+			log.Printf("未知的负载均衡策略 %s，使用 %s", balance, config.UpstreamBalance)
+		}
+	}
+
+	if cooldown := os.Getenv("ACCOUNT_COOLDOWN"); cooldown != "" {
+		if n, err := strconv.Atoi(cooldown); err == nil && n >= 0 {
+			config.AccountCooldown = n
+		}
+	}
+
+	if quarantine := os.Getenv("ACCOUNT_QUARANTINE"); quarantine != "" {
+		if n, err := strconv.Atoi(quarantine); err == nil && n >= 0 {
+			config.AccountQuarantine = n
+		}
+	}
+
+	config.AdminKey = strings.TrimSpace(os.Getenv("ADMIN_KEY"))
+
+	if strategy := os.Getenv("SYSTEM_STRATEGY"); strategy != "" {
+		if validSystemStrategy(strategy) {
+			config.SystemStrategy = strategy
+		} else {
+			log.Printf("未知的系统提示注入策略 %s，使用 %s", strategy, config.SystemStrategy)
+		}
+	}
+
+	if window := os.Getenv("CONTEXT_WINDOW"); window != "" {
+		if n, err := strconv.Atoi(window); err == nil && n >= 0 {
+			config.ContextWindow = n
+		}
+	}
+
+	if strategy := os.Getenv("CONTEXT_STRATEGY"); strategy != "" {
+		if validContextStrategy(strategy) {
+			config.ContextStrategy = strategy
+		} else {
+			log.Printf("未知的上下文策略 %s，使用 %s", strategy, config.ContextStrategy)
+		}
+	}
+
+	if prefillInclude := os.Getenv("PREFILL_INCLUDE"); prefillInclude != "" {
+		if b, err := strconv.ParseBool(prefillInclude); err == nil {
+			config.PrefillInclude = b
+		}
+	}
+
+	// 自定义角色映射为 JSON 对象，例如 {"critic": "user", "narrator": "system"}
+	if roleMap := os.Getenv("ROLE_MAP"); roleMap != "" {
+		var mapping map[string]string
+		if err := json.Unmarshal([]byte(roleMap), &mapping); err != nil {
+			log.Printf("解析 ROLE_MAP 出错: %v", err)
+		}
+		config.RoleMap = make(map[string]string)
+		for role, target := range mapping {
+			if isBuiltinRole(role) || !validRoleTarget(target) {
+				log.Printf("忽略无效的角色映射 %s -> %s，只能将自定义角色映射为 system、user 或 assistant", role, target)
+				continue
+			}
+			config.RoleMap[role] = target
+		}
+	}
+
+	if nameLabels := os.Getenv("NAME_LABELS"); nameLabels != "" {
+		if b, err := strconv.ParseBool(nameLabels); err == nil {
+			config.NameLabels = b
+		}
+	}
 }
 
 func init() {
 	loadConfig()
 	loadClientAPIKeys()
 	loadModels()
+	initTransport()
+	loadUpstreams()
+	loadAccounts()
+	loadPromptTemplates()
 }
 
 func loadClientAPIKeys() {
@@ -229,7 +493,7 @@ func loadModels() {
 		return
 	}
 
-	if err := json.Unmarshal(data, &modelsMap); err != nil {
+	if err := loadModelConfigs(data); err != nil {
 		log.Printf("解析 models.json 出错: %v", err)
 		return
 	}
@@ -242,44 +506,80 @@ func authenticateClient(c *gin.Context) {
 		return
 	}
 
+	// Anthropic SDK 通过 x-api-key 头传递密钥
+	if apiKey := c.GetHeader("x-api-key"); apiKey != "" && c.GetHeader("Authorization") == "" {
+		if !validClientKeys[apiKey] {
+			abortUnauthorized(c, "Invalid API key")
+			return
+		}
+		c.Next()
+		return
+	}
+
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization header"})
-		c.Abort()
+		abortUnauthorized(c, "Missing authorization header")
 		return
 	}
 
 	// 提取 Bearer token
 	parts := strings.Split(authHeader, " ")
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
-		c.Abort()
+		abortUnauthorized(c, "Invalid authorization format")
 		return
 	}
 
 	token := parts[1]
 	if !validClientKeys[token] {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
-		c.Abort()
+		abortUnauthorized(c, "Invalid API key")
 		return
 	}
 
 	c.Next()
 }
 
+// authenticateAdmin 校验管理接口的密钥（ADMIN_KEY），与客户端 API 密钥分开
+func authenticateAdmin(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminKey)) != 1 {
+		writeAPIError(c, errInvalidAPIKey("Invalid admin key"))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// abortUnauthorized 按请求的接口格式输出认证错误：Anthropic 接口使用 Anthropic 格式，
+// Ollama 接口使用 Ollama 的字符串格式，其余使用 OpenAI 格式
+func abortUnauthorized(c *gin.Context, message string) {
+	switch path := c.FullPath(); {
+	case path == "/v1/messages":
+		writeAnthropicError(c, http.StatusUnauthorized, "authentication_error", message)
+	case strings.HasPrefix(path, "/api/"):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+	default:
+		writeAPIError(c, errInvalidAPIKey(message))
+	}
+	c.Abort()
+}
+
 // 记录请求统计信息
-func recordRequestStats(startTime time.Time, path string, status int) {
+func recordRequestStats(startTime time.Time, path string, status int, retries int) {
 	duration := time.Since(startTime)
 	
 	statsMutex.Lock()
 	defer statsMutex.Unlock()
 	
 	stats.TotalRequests++
+	stats.UpstreamRetries += int64(retries)
 	stats.LastRequestTime = time.Now()
 	
-	if status >= 200 && status < 300 {
+	switch requestOutcome(status) {
+	case outcomeSuccess:
 		stats.SuccessfulRequests++
-	} else {
+	case outcomeClientCancelled:
+		stats.ClientCancelledRequests++
+	default:
 		stats.FailedRequests++
 	}
 	
@@ -292,8 +592,23 @@ func recordRequestStats(startTime time.Time, path string, status int) {
 	}
 }
 
+// trackRequest 记录一次 API 请求的统计信息和实时请求信息。
+// 客户端在处理过程中断开时，无论处理结果如何都记为 499 client_cancelled
+func trackRequest(c *gin.Context, startTime time.Time, status int) {
+	if c.Request.Context().Err() != nil {
+		status = statusClientClosedRequest
+		if config.DebugMode {
+			log.Printf("客户端已断开: %s %s", c.Request.Method, c.Request.URL.Path)
+		}
+	}
+	duration := time.Since(startTime)
+	retries := upstreamRetries(c.Request.Context())
+	recordRequestStats(startTime, c.Request.URL.Path, status, retries)
+	addLiveRequest(c.Request.Method, c.Request.URL.Path, status, duration, retries, c.Request.UserAgent(), c.GetString(promptTemplateKey))
+}
+
 // 添加实时请求信息
-func addLiveRequest(method, path string, status int, duration time.Duration, _, userAgent string) {
+func addLiveRequest(method, path string, status int, duration time.Duration, retries int, userAgent string, template string) {
 	requestsMutex.Lock()
 	defer requestsMutex.Unlock()
 	
@@ -305,6 +620,9 @@ func addLiveRequest(method, path string, status int, duration time.Duration, _,
 		Status:    status,
 		Duration:  duration.Milliseconds(),
 		UserAgent: userAgent,
+		Outcome:   requestOutcome(status),
+		Retries:   retries,
+		Template:  template,
 	}
 	
 	liveRequests = append(liveRequests, request)
@@ -362,27 +680,32 @@ func listModels(c *gin.Context) {
 
 func chatCompletions(c *gin.Context) {
 	startTime := time.Now()
-	path := c.Request.URL.Path
-	userAgent := c.Request.UserAgent()
-	
+
 	var req ChatCompletionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
 		// 记录请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, http.StatusBadRequest)
-		addLiveRequest("POST", path, http.StatusBadRequest, duration, "", userAgent)
+		trackRequest(c, startTime, http.StatusBadRequest)
 		return
 	}
 
 	if len(req.Messages) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Messages required"})
+		writeAPIError(c, errInvalidRequest("messages", "", "messages: at least one message is required"))
+		// 记录请求统计
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 展开引用的提示词模板
+	model, templatePrompt, err := resolvePromptTemplate(c, req.Model, req.PromptTemplate)
+	if err != nil {
+		apiErr := requestAPIError(err, "prompt_template")
+		writeAPIError(c, apiErr)
 		// 记录请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, http.StatusBadRequest)
-		addLiveRequest("POST", path, http.StatusBadRequest, duration, "", userAgent)
+		trackRequest(c, startTime, apiErr.Status)
 		return
 	}
+	req.Model = model
 
 	// 应用默认配置
 	if req.Model == "" {
@@ -398,29 +721,48 @@ func chatCompletions(c *gin.Context) {
 		req.Stream = config.DefaultStream
 	}
 
-	// 处理消息历史
-	messagesHistory := []TalkAIMessage{}
-	systemPrompt := ""
+	// 解析工具调用设置
+	tools, err := resolveToolSettings(&req)
+	if err == nil {
+		err = validateResponseFormat(req.ResponseFormat)
+	}
+	if err == nil {
+		err = validateOutputLimits(req.Stop, req.MaxTokens, req.MaxCompletionTokens)
+	}
+	if err == nil {
+		err = validateChoiceCount(req.N)
+	}
+	if err != nil {
+		writeAPIError(c, requestAPIError(err, ""))
+		// 记录请求统计
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
 
-	for _, msg := range req.Messages {
-		if msg.Role == "system" {
-			systemPrompt = msg.Content
-		} else if msg.Role == "user" || msg.Role == "assistant" {
-			from := "you"
-			if msg.Role == "assistant" {
-				from = "assistant"
-			}
-			messagesHistory = append(messagesHistory, TalkAIMessage{
-				ID:      uuid.New().String(),
-				From:    from,
-				Content: msg.Content,
-			})
-		}
+	// 处理消息历史，末尾的助手消息作为回复的开头
+	messages, prefill := splitPrefill(req.Messages)
+	messagesHistory, err := buildMessagesHistory(prependSystemPrompt(messages, templatePrompt), req.Model, buildToolPrompt(tools), buildResponseFormatPrompt(req.ResponseFormat))
+	if err != nil {
+		writeAPIError(c, requestAPIError(err, "messages"))
+		// 记录请求统计
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	messagesHistory = appendPrefillInstruction(messagesHistory, prefill)
+	includePrefill := config.PrefillInclude
+	if req.IncludePrefill != nil {
+		includePrefill = *req.IncludePrefill
 	}
 
-	// 如果有系统提示且最后一条消息是用户消息，则合并
-	if systemPrompt != "" && len(messagesHistory) > 0 && messagesHistory[len(messagesHistory)-1].From == "you" {
-		messagesHistory[len(messagesHistory)-1].Content = fmt.Sprintf("%s\n\n%s", systemPrompt, messagesHistory[len(messagesHistory)-1].Content)
+	// 检查上下文长度，超长时按模型的上下文策略处理
+	maxTokens := req.maxOutputTokens()
+	messagesHistory, err = fitContext(c, messagesHistory, req.Model, maxTokens)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAPIError(c, apiErr)
+		// 记录请求统计
+		trackRequest(c, startTime, apiErr.Status)
+		return
 	}
 
 	// 构建 TalkAI 请求
@@ -431,6 +773,7 @@ func chatCompletions(c *gin.Context) {
 			"model":       req.Model,
 			"temperature": req.Temperature,
 		},
+		prefill: prefill,
 	}
 
 	// 设置默认温度
@@ -438,92 +781,189 @@ func chatCompletions(c *gin.Context) {
 		talkAIReq.Settings["temperature"] = 0.7
 	}
 
-	// 发送请求到 TalkAI
-	resp, err := sendToTalkAI(talkAIReq)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
-		// 记录请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, http.StatusInternalServerError)
-		addLiveRequest("POST", path, http.StatusInternalServerError, duration, "", userAgent)
+	output := &chatOutput{
+		Model:        req.Model,
+		Tools:        tools,
+		PromptTokens: estimatePromptTokens(messagesHistory),
+		IncludeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+	}
+	if includePrefill {
+		output.Prefill = prefill
+	}
+
+	// JSON 模式需要先拿到完整输出进行校验，不能直接转发上游的流
+	n := req.choiceCount()
+	if req.ResponseFormat.jsonMode() {
+		results, err := completeStructuredOutputs(c.Request.Context(), talkAIReq, req.ResponseFormat, tools, req.Stop, maxTokens, n)
+		if err != nil {
+			apiErr := upstreamAPIError(err)
+			writeAPIError(c, apiErr)
+			// 记录请求统计
+			trackRequest(c, startTime, apiErr.Status)
+			return
+		}
+		// 校验的是包含回复开头的完整输出，不返回开头时再去掉
+		output.Prefill = ""
+		if !includePrefill {
+			for i := range results {
+				results[i].Content = strings.TrimPrefix(results[i].Content, prefill)
+			}
+		}
+
+		if req.Stream {
+			// 输出已经在 completeStructuredOutput 中限制过
+			sources := make([]choiceSource, len(results))
+			for i, result := range results {
+				content := result.Content
+				sources[i] = choiceSource{
+					Limiter: passthroughLimiter(result.FinishReason),
+					Read: func(emit func(string) bool) error {
+						emit(content)
+						return nil
+					},
+				}
+			}
+			err = streamChatCompletion(c, output, sources)
+		} else {
+			writeChatCompletion(c, output, results)
+		}
+		if err != nil {
+			// 记录请求统计
+			trackRequest(c, startTime, upstreamAPIError(err).Status)
+			return
+		}
+		// 记录成功请求统计
+		trackRequest(c, startTime, http.StatusOK)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		c.JSON(resp.StatusCode, gin.H{"error": "TalkAI API error"})
+	// 发送请求到上游，n > 1 时并发发送多个相同的请求
+	streams, err := openStreams(c.Request.Context(), talkAIReq, n)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAPIError(c, apiErr)
 		// 记录请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, resp.StatusCode)
-		addLiveRequest("POST", path, resp.StatusCode, duration, "", userAgent)
+		trackRequest(c, startTime, apiErr.Status)
 		return
 	}
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
 
 	if req.Stream {
-		handleStreamResponse(c, resp, req.Model)
-		// 记录成功请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, http.StatusOK)
-		addLiveRequest("POST", path, http.StatusOK, duration, "", userAgent)
+		err = handleStreamResponse(c, streams, output, req.Stop, maxTokens)
 	} else {
-		handleNormalResponse(c, resp, req.Model)
-		// 记录成功请求统计
-		duration := time.Since(startTime)
-		recordRequestStats(startTime, path, http.StatusOK)
-		addLiveRequest("POST", path, http.StatusOK, duration, "", userAgent)
+		err = handleNormalResponse(c, streams, output, req.Stop, maxTokens)
 	}
-}
-
-func sendToTalkAI(req TalkAIRequest) (*http.Response, error) {
-	jsonData, err := json.Marshal(req)
 	if err != nil {
-		return nil, err
+		// 流式响应已经发送了错误分块，这里只记录请求统计
+		apiErr := upstreamAPIError(err)
+		if !req.Stream {
+			writeAPIError(c, apiErr)
+		}
+		trackRequest(c, startTime, apiErr.Status)
+		return
 	}
+	// 记录成功请求统计
+	trackRequest(c, startTime, http.StatusOK)
+}
 
-	httpReq, err := http.NewRequest("POST", "https://claude.talkai.info/chat/send/", strings.NewReader(string(jsonData)))
+// chatOutput 生成 chat.completion 响应所需的请求信息
+type chatOutput struct {
+	Model        string
+	Tools        *toolSettings
+	PromptTokens int
+	// IncludeUsage 流式响应结束前是否发送用量分块（stream_options.include_usage）
+	IncludeUsage bool
+	// Prefill 返回给客户端的回复开头，输出在它之后继续；不返回开头时为空
+	Prefill string
+}
+
+// handleNormalResponse 读取上游出错时不写入响应，返回错误由调用方输出
+func handleNormalResponse(c *gin.Context, streams []EventStream, output *chatOutput, stops []string, maxTokens int) error {
+	// 这里需要解析 TalkAI 的响应并转换为 OpenAI 格式
+	// 由于 TalkAI 返回的是流式格式，我们需要聚合所有内容
+	results, err := aggregateChoices(streams, stops, maxTokens)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	writeChatCompletion(c, output, results)
+	return nil
+}
 
-	httpReq.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-	httpReq.Header.Set("Accept", "application/json, text/event-stream")
-	httpReq.Header.Set("Content-Type", "application/json")
+// writeChatCompletion 将每个 choice 的完整输出写为非流式响应
+func writeChatCompletion(c *gin.Context, output *chatOutput, results []choiceResult) {
+	tools := output.Tools
+	choices := make([]ChatCompletionChoice, 0, len(results))
+	completionTokens := 0
+	for i, result := range results {
+		content := output.Prefill + result.Content
+		finishReason := result.FinishReason
+		message := ChatMessage{
+			Role:    "assistant",
+			Content: textContent(content),
+		}
 
-	client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
-	return client.Do(httpReq)
-}
+		// 解析模拟的工具调用
+		if tools.enabled() {
+			text, calls := parseToolCalls(content, tools)
+			if len(calls) > 0 {
+				message.Content = textContent(text)
+				if text == "" {
+					message.Content = MessageContent{Null: true}
+				}
+				if tools.Legacy {
+					message.FunctionCall = &calls[0].Function
+				} else {
+					message.ToolCalls = calls
+				}
+				finishReason = toolFinishReason(tools)
+			}
+		}
 
-func handleNormalResponse(c *gin.Context, resp *http.Response, model string) {
-	// 这里需要解析 TalkAI 的响应并转换为 OpenAI 格式
-	// 由于 TalkAI 返回的是流式格式，我们需要聚合所有内容
-	content := aggregateStreamContent(resp)
+		choices = append(choices, ChatCompletionChoice{
+			Message:      message,
+			Index:        i,
+			FinishReason: finishReason,
+		})
+		completionTokens += estimateTokens(result.Content)
+	}
 
 	response := ChatCompletionResponse{
 		ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   model,
-		Choices: []ChatCompletionChoice{
-			{
-				Message: ChatMessage{
-					Role:    "assistant",
-					Content: content,
-				},
-				Index:        0,
-				FinishReason: "stop",
-			},
-		},
-		Usage: map[string]int{
-			"prompt_tokens":     0,
-			"completion_tokens": 0,
-			"total_tokens":      0,
-		},
+		Model:   output.Model,
+		Choices: choices,
+		Usage:   usageMap(output.PromptTokens, completionTokens),
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
-func handleStreamResponse(c *gin.Context, resp *http.Response, model string) {
+func handleStreamResponse(c *gin.Context, streams []EventStream, output *chatOutput, stops []string, maxTokens int) error {
+	sources := make([]choiceSource, len(streams))
+	for i, stream := range streams {
+		stream := stream
+		sources[i] = choiceSource{
+			Limiter: newOutputLimiter(stops, maxTokens),
+			Read: func(emit func(string) bool) error {
+				return forEachStreamChunk(stream, emit)
+			},
+		}
+	}
+	return streamChatCompletion(c, output, sources)
+}
+
+// streamChatCompletion 以 chat.completion.chunk 格式输出各个 choice 的内容片段。
+// 每个 choice 在单独的 goroutine 中读取并截断，分块按到达顺序交错发送，
+// 某个 choice 结束时立即发送它的结束分块。任意一个 choice 读取出错时发送 OpenAI 格式的错误分块
+// 并结束响应（不发送 [DONE]），返回该错误
+func streamChatCompletion(c *gin.Context, output *chatOutput, sources []choiceSource) error {
+	model, tools := output.Model, output.Tools
+
 	// 设置流式响应头
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -532,97 +972,138 @@ func handleStreamResponse(c *gin.Context, resp *http.Response, model string) {
 	streamID := fmt.Sprintf("chatcmpl-%s", uuid.New().String())
 	createdTime := time.Now().Unix()
 
-	// 发送初始消息
-	initialChoice := StreamChoice{
-		Delta: map[string]interface{}{
-			"role": "assistant",
-		},
-		Index: 0,
-	}
-
-	initialResp := StreamResponse{
-		ID:      streamID,
-		Object:  "chat.completion.chunk",
-		Created: createdTime,
-		Model:   model,
-		Choices: []StreamChoice{initialChoice},
-	}
+	chunks := readChoiceSources(c.Request.Context(), sources)
 
+	var streamErr error
 	c.Stream(func(w io.Writer) bool {
-		// 发送初始响应
-		jsonData, _ := json.Marshal(initialResp)
-		fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
-		w.(http.Flusher).Flush()
+		sendDelta := func(index int, delta map[string]interface{}) {
+			streamResp := StreamResponse{
+				ID:      streamID,
+				Object:  "chat.completion.chunk",
+				Created: createdTime,
+				Model:   model,
+				Choices: []StreamChoice{{Delta: delta, Index: index}},
+			}
 
-		// 处理流式内容
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "data:") {
-				content := strings.TrimSpace(line[5:])
-				if content != "" && content != "-1" {
-					choice := StreamChoice{
-						Delta: map[string]interface{}{
-							"content": content,
-						},
-						Index: 0,
-					}
-
-					streamResp := StreamResponse{
-						ID:      streamID,
-						Object:  "chat.completion.chunk",
-						Created: createdTime,
-						Model:   model,
-						Choices: []StreamChoice{choice},
-					}
-
-					jsonData, _ := json.Marshal(streamResp)
-					fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
-					w.(http.Flusher).Flush()
+			jsonData, _ := json.Marshal(streamResp)
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+			w.(http.Flusher).Flush()
+		}
+
+		// 发送初始消息
+		for i := range sources {
+			sendDelta(i, map[string]interface{}{"role": "assistant"})
+		}
+
+		// 启用工具调用时，输出先经过解析器，把 <tool_call> 块转换为 tool_calls 增量
+		parsers := make([]*toolCallParser, len(sources))
+		if tools.enabled() {
+			for i := range parsers {
+				parsers[i] = newToolCallParser(tools)
+			}
+		}
+		sendEvents := func(index int, events []toolEvent) {
+			for _, ev := range events {
+				if ev.Kind == toolEventText {
+					sendDelta(index, map[string]interface{}{"content": ev.Text})
+				} else {
+					sendDelta(index, toolCallsDelta(ev, tools))
 				}
 			}
 		}
 
-		// 发送结束消息
-		finishReason := "stop"
-		finalChoice := StreamChoice{
-			Delta:        map[string]interface{}{},
-			Index:        0,
-			FinishReason: &finishReason,
+		// 回复开头不计入输出限制，作为每个 choice 的第一段内容
+		if output.Prefill != "" {
+			for i, parser := range parsers {
+				if parser != nil {
+					sendEvents(i, parser.Feed(output.Prefill))
+				} else {
+					sendDelta(i, map[string]interface{}{"content": output.Prefill})
+				}
+			}
 		}
 
-		finalResp := StreamResponse{
-			ID:      streamID,
-			Object:  "chat.completion.chunk",
-			Created: createdTime,
-			Model:   model,
-			Choices: []StreamChoice{finalChoice},
+		// 处理流式内容
+		var completionTokens int
+		for chunk := range chunks {
+			if chunk.Err != nil {
+				// 剩余的 choice 在请求结束后随 context 取消退出
+				streamErr = chunk.Err
+				jsonData, _ := json.Marshal(apiErrorBody(upstreamAPIError(chunk.Err)))
+				fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+				w.(http.Flusher).Flush()
+				return false
+			}
+			parser := parsers[chunk.Index]
+			if !chunk.Done {
+				if parser != nil {
+					sendEvents(chunk.Index, parser.Feed(chunk.Content))
+				} else {
+					sendDelta(chunk.Index, map[string]interface{}{"content": chunk.Content})
+				}
+				continue
+			}
+
+			// 发送结束消息
+			completionTokens += chunk.Tokens
+			finishReason := sources[chunk.Index].Limiter.FinishReason()
+			if parser != nil {
+				sendEvents(chunk.Index, parser.Flush())
+				if parser.Count() > 0 {
+					finishReason = toolFinishReason(tools)
+				}
+			}
+			finalResp := StreamResponse{
+				ID:      streamID,
+				Object:  "chat.completion.chunk",
+				Created: createdTime,
+				Model:   model,
+				Choices: []StreamChoice{{
+					Delta:        map[string]interface{}{},
+					Index:        chunk.Index,
+					FinishReason: &finishReason,
+				}},
+			}
+			jsonData, _ := json.Marshal(finalResp)
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+			w.(http.Flusher).Flush()
 		}
 
-		jsonData, _ = json.Marshal(finalResp)
-		fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+		// 与 OpenAI 一致，用量放在 choices 为空的最后一个分块中
+		if output.IncludeUsage {
+			usageResp := StreamResponse{
+				ID:      streamID,
+				Object:  "chat.completion.chunk",
+				Created: createdTime,
+				Model:   model,
+				Choices: []StreamChoice{},
+				Usage:   usageMap(output.PromptTokens, completionTokens),
+			}
+			jsonData, _ := json.Marshal(usageResp)
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+		}
 		fmt.Fprintf(w, "data: [DONE]\n\n")
 		w.(http.Flusher).Flush()
 
 		return false
 	})
+	return streamErr
 }
 
-func aggregateStreamContent(resp *http.Response) string {
+// aggregateStreamContent 聚合上游事件流的全部内容，并按 limiter 截断。
+// 读取中途出错时返回错误，不返回不完整的内容
+func aggregateStreamContent(stream EventStream, limiter *outputLimiter) (string, error) {
 	var content strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
-	
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "data:") {
-			data := strings.TrimSpace(line[5:])
-			if data != "" && data != "-1" {
-				content.WriteString(data)
-			}
-		}
+	err := forEachStreamChunk(stream, func(data string) bool {
+		out, done := limiter.Feed(data)
+		content.WriteString(out)
+		return !done
+	})
+	if err != nil {
+		return "", err
 	}
-	
-	return content.String()
+	content.WriteString(limiter.Flush())
+	return content.String(), nil
 }
 
 // Dashboard页面处理器
@@ -698,6 +1179,9 @@ func handleDashboard(c *gin.Context) {
 	       .status-error {
 	           color: #dc3545;
 	       }
+	       .status-cancelled {
+	           color: #6c757d;
+	       }
 	       .refresh-info {
 	           text-align: center;
 	           margin-top: 20px;
@@ -753,12 +1237,59 @@ func handleDashboard(c *gin.Context) {
 	               <div class="stat-value" id="failed-requests">0</div>
 	               <div class="stat-label">失败请求</div>
 	           </div>
+	           <div class="stat-card">
+	               <div class="stat-value" id="client-cancelled-requests">0</div>
+	               <div class="stat-label">客户端取消</div>
+	           </div>
+	           <div class="stat-card">
+	               <div class="stat-value" id="upstream-retries">0</div>
+	               <div class="stat-label">上游重试</div>
+	           </div>
 	           <div class="stat-card">
 	               <div class="stat-value" id="avg-response-time">0s</div>
 	               <div class="stat-label">平均响应时间</div>
 	           </div>
 	       </div>
 	       
+	       <h2>上游连接池</h2>
+	       <div class="stats-container">
+	           <div class="stat-card">
+	               <div class="stat-value" id="new-connections">0</div>
+	               <div class="stat-label">新建连接</div>
+	           </div>
+	           <div class="stat-card">
+	               <div class="stat-value" id="reuse-rate">0%</div>
+	               <div class="stat-label">连接复用率</div>
+	           </div>
+	           <div class="stat-card">
+	               <div class="stat-value" id="tls-handshakes">0</div>
+	               <div class="stat-label">TLS 握手次数</div>
+	           </div>
+	           <div class="stat-card">
+	               <div class="stat-value" id="avg-tls-handshake">0ms</div>
+	               <div class="stat-label">平均 TLS 握手耗时</div>
+	           </div>
+	       </div>
+	       
+	       <div class="requests-container">
+	           <h2>熔断器</h2>
+	           <table class="requests-table">
+	               <thead>
+	                   <tr>
+	                       <th>上游</th>
+	                       <th>模型</th>
+	                       <th>状态</th>
+	                       <th>连续失败</th>
+	                       <th>打开次数</th>
+	                       <th>拒绝请求</th>
+	                       <th>最近错误</th>
+	                   </tr>
+	               </thead>
+	               <tbody id="breakers-tbody">
+	               </tbody>
+	           </table>
+	       </div>
+	       
 	       <div class="chart-container">
 	           <h2>请求统计图表</h2>
 	           <canvas id="requestsChart"></canvas>
@@ -774,6 +1305,8 @@ func handleDashboard(c *gin.Context) {
 	                       <th>方法</th>
 	                       <th>状态</th>
 	                       <th>耗时</th>
+	                       <th>重试</th>
+	                       <th>模板</th>
 	                       <th>User Agent</th>
 	                   </tr>
 	               </thead>
@@ -809,11 +1342,65 @@ func handleDashboard(c *gin.Context) {
 	                   document.getElementById('total-requests').textContent = data.total_requests;
 	                   document.getElementById('successful-requests').textContent = data.successful_requests;
 	                   document.getElementById('failed-requests').textContent = data.failed_requests;
+	                   document.getElementById('client-cancelled-requests').textContent = data.client_cancelled_requests;
+	                   document.getElementById('upstream-retries').textContent = data.upstream_retries;
 	                   document.getElementById('avg-response-time').textContent = (data.average_response_time / 1000000000).toFixed(2) + 's';
 	               })
 	               .catch(error => console.error('Error fetching stats:', error));
 	       }
 	       
+	       // 更新连接池统计
+	       function updateTransport() {
+	           fetch('/dashboard/transport')
+	               .then(response => response.json())
+	               .then(data => {
+	                   document.getElementById('new-connections').textContent = data.new_connections;
+	                   document.getElementById('reuse-rate').textContent = (data.reuse_rate * 100).toFixed(1) + '%';
+	                   document.getElementById('tls-handshakes').textContent = data.tls_handshakes;
+	                   document.getElementById('avg-tls-handshake').textContent = data.avg_tls_handshake_ms.toFixed(1) + 'ms';
+	               })
+	               .catch(error => console.error('Error fetching transport stats:', error));
+	       }
+	       
+	       // 更新熔断器状态
+	       function updateBreakers() {
+	           fetch('/dashboard/breakers')
+	               .then(response => response.json())
+	               .then(data => {
+	                   const tbody = document.getElementById('breakers-tbody');
+	                   tbody.innerHTML = '';
+	                   if (!data.breakers || data.breakers.length === 0) {
+	                       tbody.innerHTML = '<tr><td colspan="7" style="text-align: center;">暂无上游请求</td></tr>';
+	                       return;
+	                   }
+	                   const stateText = {closed: '关闭（正常）', open: '打开（拒绝请求）', half_open: '半开（探测中）'};
+	                   data.breakers.forEach(b => {
+	                       const row = document.createElement('tr');
+	                       const stateClass = b.state === 'closed' ? 'status-success' : 'status-error';
+	                       const lastError = b.last_error || '';
+	                       // 上游地址、模型和错误信息来自请求和上游响应，用 textContent 写入避免被当作 HTML 解析
+	                       const cells = [
+	                           b.upstream,
+	                           b.model,
+	                           stateText[b.state] || b.state,
+	                           b.consecutive_failures,
+	                           b.opens,
+	                           b.rejected,
+	                           lastError.length > 40 ? lastError.substring(0, 40) + "..." : lastError
+	                       ];
+	                       cells.forEach((value, i) => {
+	                           const td = document.createElement('td');
+	                           td.textContent = value;
+	                           if (i === 2) td.className = stateClass;
+	                           if (i === 6) td.title = lastError;
+	                           row.appendChild(td);
+	                       });
+	                       tbody.appendChild(row);
+	                   });
+	               })
+	               .catch(error => console.error('Error fetching breakers:', error));
+	       }
+	       
 	       // 更新请求列表
 	       function updateRequests() {
 	           fetch('/dashboard/requests')
@@ -874,7 +1461,12 @@ func handleDashboard(c *gin.Context) {
 	               }
 	               
 	               // 状态样式
-	               const statusClass = request.status >= 200 && request.status < 300 ? 'status-success' : 'status-error';
+	               let statusClass = request.status >= 200 && request.status < 300 ? 'status-success' : 'status-error';
+	               let statusText = request.status || "undefined";
+	               if (request.outcome === 'client_cancelled') {
+	                   statusClass = 'status-cancelled';
+	                   statusText = request.status + " 客户端取消";
+	               }
 	               
 	               // 截断 User Agent，避免过长
 	               let userAgent = request.user_agent || "undefined";
@@ -886,8 +1478,10 @@ func handleDashboard(c *gin.Context) {
 	                  "<td>" + timeStr + "</td>" +
 	                  "<td>Claude</td>" +
 	                  "<td>" + (request.method || "undefined") + "</td>" +
-	                  "<td class=\"" + statusClass + "\">" + (request.status || "undefined") + "</td>" +
+	                  "<td class=\"" + statusClass + "\">" + statusText + "</td>" +
 	                  "<td>" + ((request.duration / 1000).toFixed(2) || "undefined") + "s</td>" +
+	                  "<td>" + (request.retries || 0) + "</td>" +
+	                  "<td>" + (request.template || "-") + "</td>" +
 	                  "<td title=\"" + (request.user_agent || "") + "\">" + userAgent + "</td>";
 	               
 	               tbody.appendChild(row);
@@ -982,10 +1576,14 @@ func handleDashboard(c *gin.Context) {
 	       
 	       // 初始加载
 	       updateStats();
+	       updateTransport();
+	       updateBreakers();
 	       updateRequests();
 	       
 	       // 定时刷新
 	       setInterval(updateStats, 5000);
+	       setInterval(updateTransport, 5000);
+	       setInterval(updateBreakers, 5000);
 	       setInterval(updateRequests, 5000);
 	   </script>
 </body>
@@ -1007,6 +1605,21 @@ func handleDashboardRequests(c *gin.Context) {
 	c.Data(http.StatusOK, "application/json", getLiveRequestsData())
 }
 
+// Dashboard上游状态处理器
+func handleDashboardUpstreams(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"upstreams": getUpstreamsData()})
+}
+
+// Dashboard连接池统计处理器
+func handleDashboardTransport(c *gin.Context) {
+	c.JSON(http.StatusOK, getTransportData())
+}
+
+// Dashboard熔断器状态处理器
+func handleDashboardBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": getBreakersData()})
+}
+
 // API文档页面处理器
 func handleDocs(c *gin.Context) {
 	// API文档HTML模板
@@ -1182,6 +1795,10 @@ func handleDocs(c *gin.Context) {
 	                   <ul>
 	                       <li><a href="#models">获取模型列表</a></li>
 	                       <li><a href="#chat-completions">聊天完成</a></li>
+	                       <li><a href="#completions">文本补全（旧版）</a></li>
+	                       <li><a href="#anthropic-messages">Anthropic Messages</a></li>
+	                       <li><a href="#responses">Responses</a></li>
+	                       <li><a href="#ollama">Ollama 兼容接口</a></li>
 	                   </ul>
 	               </li>
 	               <li><a href="#examples">使用示例</a></li>
@@ -1281,6 +1898,66 @@ Authorization: Bearer your-api-key</div>
 	                               <td>否</td>
 	                               <td>采样温度，控制随机性</td>
 	                           </tr>
+	                           <tr>
+	                               <td>tools</td>
+	                               <td>array</td>
+	                               <td>否</td>
+	                               <td>可调用的工具列表（OpenAI 格式）。代理将工具定义注入提示词，并把模型输出解析为 tool_calls，finish_reason 为 "tool_calls"</td>
+	                           </tr>
+	                           <tr>
+	                               <td>tool_choice</td>
+	                               <td>string | object</td>
+	                               <td>否</td>
+	                               <td>"none"、"auto"、"required" 或 {"type": "function", "function": {"name": "..."}}</td>
+	                           </tr>
+	                           <tr>
+	                               <td>functions / function_call</td>
+	                               <td>array / string | object</td>
+	                               <td>否</td>
+	                               <td>旧版函数调用字段，响应中返回 function_call，finish_reason 为 "function_call"</td>
+	                           </tr>
+	                           <tr>
+	                               <td>response_format</td>
+	                               <td>object</td>
+	                               <td>否</td>
+	                               <td>{"type": "json_object"} 或 {"type": "json_schema", "json_schema": {"name": "...", "schema": {...}}}。代理会校验输出，不合格时最多重试 JSON_MODE_MAX_RETRIES 次，仍失败返回 502</td>
+	                           </tr>
+	                           <tr>
+	                               <td>stop</td>
+	                               <td>string | array</td>
+	                               <td>否</td>
+	                               <td>停止序列，最多 4 个。输出在第一个停止序列处截断，停止序列本身不返回</td>
+	                           </tr>
+	                           <tr>
+	                               <td>max_tokens / max_completion_tokens</td>
+	                               <td>integer</td>
+	                               <td>否</td>
+	                               <td>输出 token 上限（本地估算），达到上限时 finish_reason 为 "length"</td>
+	                           </tr>
+	                           <tr>
+	                               <td>stream_options</td>
+	                               <td>object</td>
+	                               <td>否</td>
+	                               <td>{"include_usage": true} 时流式响应在结束前发送一个带 usage 的分块</td>
+	                           </tr>
+	                           <tr>
+	                               <td>n</td>
+	                               <td>integer</td>
+	                               <td>否</td>
+	                               <td>生成的 choice 数量（1~8，默认 1），每个 choice 对应一次并发的上游请求</td>
+	                           </tr>
+	                           <tr>
+	                               <td>prompt_template</td>
+	                               <td>object</td>
+	                               <td>否</td>
+	                               <td>扩展字段，{"name": "...", "variables": {...}} 引用服务端的提示词模板，也可以用 model 后缀指定模板（如 "claude-sonnet-4-20250514@support-bot"）</td>
+	                           </tr>
+	                           <tr>
+	                               <td>include_prefill</td>
+	                               <td>boolean</td>
+	                               <td>否</td>
+	                               <td>扩展字段，messages 以助手消息结尾时该消息作为回复开头，模型从它的结尾续写；为 true 时响应包含开头，默认由 PREFILL_INCLUDE 决定</td>
+	                           </tr>
 	                       </tbody>
 	                   </table>
 	               </div>
@@ -1298,17 +1975,79 @@ Authorization: Bearer your-api-key</div>
 	                           <tr>
 	                               <td>role</td>
 	                               <td>string</td>
-	                               <td>消息角色，可选值：system、user、assistant</td>
+	                               <td>消息角色，可选值：system、developer、user、assistant、tool（工具结果，需带 tool_call_id）、function（旧版函数结果），以及 ROLE_MAP 中配置的自定义角色。其他角色返回 400 错误</td>
 	                           </tr>
 	                           <tr>
-	                               <td>content</td>
+	                               <td>name</td>
 	                               <td>string</td>
-	                               <td>消息内容</td>
+	                               <td>发言者名称，user 和 assistant 消息以 "名称: 内容" 的形式显示给模型（NAME_LABELS=false 时忽略）；tool / function 消息为函数名</td>
+	                           </tr>
+	                           <tr>
+	                               <td>content</td>
+	                               <td>string | array</td>
+	                               <td>消息内容，可以是字符串，也可以是 [{"type": "text", "text": "..."}] 形式的片段数组（仅支持 text 片段，image_url、input_audio、file 会返回 400 错误）</td>
 	                           </tr>
 	                       </tbody>
 	                   </table>
 	               </div>
 	           </div>
+	           
+	           <div class="endpoint" id="completions">
+	               <h3>文本补全（旧版）</h3>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/v1/completions</span>
+	               </div>
+	               <div class="description">
+	                   <p>兼容 OpenAI 旧版 text completions 接口。支持 prompt（字符串或字符串数组，每个 prompt 对应一个 choice）、suffix、echo、stop、max_tokens（默认 16）、stream，流式响应返回 text_completion 分块。</p>
+	               </div>
+	           </div>
+	           
+	           <div class="endpoint" id="anthropic-messages">
+	               <h3>Anthropic Messages</h3>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/v1/messages</span>
+	               </div>
+	               <div class="description">
+	                   <p>兼容 Anthropic Messages API，可以直接使用 Anthropic SDK（base_url 指向 http://localhost:9091）。支持顶层 system、内容块、max_tokens、stop_sequences、tools，以及 message_start / content_block_start / content_block_delta / content_block_stop / message_delta / message_stop 流式事件。</p>
+	                   <p>认证可以使用 <code>x-api-key</code> 请求头或 <code>Authorization: Bearer</code>。</p>
+	               </div>
+	           </div>
+	           <div class="endpoint" id="responses">
+	               <h3>Responses</h3>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/v1/responses</span>
+	               </div>
+	               <div class="description">
+	                   <p>兼容 OpenAI Responses API。支持 input（字符串或输入项数组，包括 message / function_call / function_call_output）、instructions、max_output_tokens、函数工具，以及 response.created / response.output_text.delta / response.function_call_arguments.delta / response.completed 等流式事件。</p>
+	                   <p>响应默认保存在内存中（最多 1000 个，store 为 false 时不保存），之后的请求通过 previous_response_id 续接对话，无需重新发送历史。instructions 只作用于当前响应，不会被续接。保存的响应可以通过 <code>GET /v1/responses/{id}</code> 查询、<code>DELETE /v1/responses/{id}</code> 删除，服务重启后清空。</p>
+	               </div>
+	           </div>
+	           <div class="endpoint" id="ollama">
+	               <h3>Ollama 兼容接口</h3>
+	               <div>
+	                   <span class="method get">GET</span>
+	                   <span class="path">/api/tags</span>
+	               </div>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/api/show</span>
+	               </div>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/api/chat</span>
+	               </div>
+	               <div>
+	                   <span class="method post">POST</span>
+	                   <span class="path">/api/generate</span>
+	               </div>
+	               <div class="description">
+	                   <p>兼容 Ollama 协议，供只支持 Ollama 的本地工具（Open WebUI、Continue 等）直接接入。stream 默认为 true，流式响应为 NDJSON，每行一个 JSON 对象，最后一行 done 为 true 并带有 done_reason 和 eval_count 等统计。支持 options.temperature / num_predict / stop、format（"json" 或 JSON schema）以及 tools。</p>
+	                   <p>模型名为 models.json 中的模型 ID，可带 :latest 后缀。设置 OLLAMA_AUTH=false 时这些接口不校验 API 密钥。</p>
+	               </div>
+	           </div>
 	       </section>
 	       
 	       <section id="examples">
@@ -1440,7 +2179,7 @@ chatWithClaude('你好，请介绍一下JavaScript', false);</div>
 	       
 	       <section id="error-handling">
 	           <h2>错误处理</h2>
-	           <p>API使用标准HTTP状态码来表示请求的成功或失败：</p>
+	           <p>API使用标准HTTP状态码来表示请求的成功或失败，错误响应体与 OpenAI 相同：<code>{"error": {"message", "type", "param", "code"}}</code>，上游错误的详情保留在 message 中：</p>
 	           <table>
 	               <thead>
 	                   <tr>
@@ -1461,10 +2200,30 @@ chatWithClaude('你好，请介绍一下JavaScript', false);</div>
 	                       <td>401 Unauthorized</td>
 	                       <td>API密钥无效或缺失</td>
 	                   </tr>
+	                   <tr>
+	                       <td>404 Not Found</td>
+	                       <td>请求的资源（如保存的响应）不存在</td>
+	                   </tr>
+	                   <tr>
+	                       <td>429 Too Many Requests</td>
+	                       <td>上游限流（rate_limit_exceeded），按 Retry-After 响应头等待后重试</td>
+	                   </tr>
 	                   <tr>
 	                       <td>500 Internal Server Error</td>
 	                       <td>服务器内部错误</td>
 	                   </tr>
+	                   <tr>
+	                       <td>502 Bad Gateway</td>
+	                       <td>上游出错（upstream_error）、拒绝访问（upstream_forbidden、upstream_unauthorized）、返回验证页（upstream_challenge）、无法连接（upstream_connection_error）或输出过程中中断（upstream_stream_error）</td>
+	                   </tr>
+	                   <tr>
+	                       <td>503 Service Unavailable</td>
+	                       <td>上游已熔断（upstream_unavailable），按 Retry-After 响应头等待后重试</td>
+	                   </tr>
+	                   <tr>
+	                       <td>504 Gateway Timeout</td>
+	                       <td>上游请求超时（upstream_timeout）</td>
+	                   </tr>
 	               </tbody>
 	           </table>
 	           <div class="note">
@@ -1503,7 +2262,10 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	checkModelProviders()
+
 	r := gin.Default()
+	r.Use(trackUpstreamRetries)
 
 	// API 路由
 	v1 := r.Group("/v1")
@@ -1511,6 +2273,23 @@ func main() {
 	{
 		v1.GET("/models", listModels)
 		v1.POST("/chat/completions", chatCompletions)
+		v1.POST("/completions", completions)
+		v1.POST("/messages", anthropicMessages)
+		v1.POST("/responses", createResponse)
+		v1.GET("/responses/:id", getResponse)
+		v1.DELETE("/responses/:id", deleteResponse)
+	}
+
+	// Ollama 兼容路由，OLLAMA_AUTH=false 时不校验密钥，方便不支持设置密钥的本地工具接入
+	ollama := r.Group("/api")
+	if config.OllamaAuth {
+		ollama.Use(authenticateClient)
+	}
+	{
+		ollama.GET("/tags", ollamaTags)
+		ollama.POST("/show", ollamaShow)
+		ollama.POST("/chat", ollamaChat)
+		ollama.POST("/generate", ollamaGenerate)
 	}
 
 	// Dashboard 路由
@@ -1518,9 +2297,29 @@ func main() {
 		r.GET("/dashboard", handleDashboard)
 		r.GET("/dashboard/stats", handleDashboardStats)
 		r.GET("/dashboard/requests", handleDashboardRequests)
+		r.GET("/dashboard/upstreams", handleDashboardUpstreams)
+		r.GET("/dashboard/transport", handleDashboardTransport)
+		r.GET("/dashboard/breakers", handleDashboardBreakers)
 		log.Printf("Dashboard已启用，访问地址: http://localhost:%d/dashboard", config.Port)
 	}
 
+	// 管理接口，只有设置了 ADMIN_KEY 时才启用
+	if config.AdminKey != "" {
+		admin := r.Group("/admin")
+		admin.Use(authenticateAdmin)
+		{
+			admin.GET("/accounts", handleAdminListAccounts)
+			admin.POST("/accounts", handleAdminAddAccount)
+			admin.PUT("/accounts/:provider/:name", handleAdminUpdateAccount)
+			admin.POST("/accounts/:provider/:name/reset", handleAdminResetAccount)
+			admin.DELETE("/accounts/:provider/:name", handleAdminDeleteAccount)
+			admin.GET("/templates", handleAdminListTemplates)
+			admin.GET("/templates/:name", handleAdminGetTemplate)
+			admin.PUT("/templates/:name", handleAdminPutTemplate)
+			admin.DELETE("/templates/:name", handleAdminDeleteTemplate)
+		}
+	}
+
 	// Docs 路由
 	r.GET("/docs", handleDocs)
 
@@ -1533,6 +2332,28 @@ func main() {
 	log.Printf("  超时时间: %d 秒", config.Timeout)
 	log.Printf("  调试模式: %v", config.DebugMode)
 	log.Printf("  Dashboard启用: %v", config.DashboardEnabled)
+	log.Printf("  Ollama 接口认证: %v", config.OllamaAuth)
+	log.Printf("  上游地址: %s", config.UpstreamBaseURL)
+	log.Printf("  负载均衡策略: %s", config.UpstreamBalance)
+	log.Printf("  系统提示注入策略: %s", config.SystemStrategy)
+	log.Printf("  上下文窗口: %d tokens，超长时: %s", config.ContextWindow, config.ContextStrategy)
+	log.Printf("  响应包含回复开头: %v", config.PrefillInclude)
+	log.Printf("  发言者标签: %v", config.NameLabels)
+	if len(config.RoleMap) > 0 {
+		log.Printf("  自定义角色映射: %v", config.RoleMap)
+	}
+	if len(config.UpstreamProxies) > 0 {
+		log.Printf("  出站代理: 已配置 %d 个", len(config.UpstreamProxies))
+	}
+	log.Printf("  连接池: 每个主机最多 %d 个空闲连接，空闲超时 %d 秒，HTTP/2: %v",
+		config.UpstreamMaxIdleConnsPerHost, config.UpstreamIdleConnTimeout, config.UpstreamHTTP2)
+	if accounts := getAccountsData(); len(accounts) > 0 {
+		log.Printf("  上游账号: 已配置 %d 个", len(accounts))
+	}
+	if templates := getPromptTemplatesData(); len(templates) > 0 {
+		log.Printf("  提示词模板: 已加载 %d 个", len(templates))
+	}
+	log.Printf("  管理接口启用: %v", config.AdminKey != "")
 	if len(config.APIKeys) > 0 {
 		log.Printf("  API 密钥: 已配置 %d 个", len(config.APIKeys))
 	}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ContentPart OpenAI 多段消息内容中的单个片段
+type ContentPart struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text,omitempty"`
+	ImageURL   json.RawMessage `json:"image_url,omitempty"`
+	InputAudio json.RawMessage `json:"input_audio,omitempty"`
+	File       json.RawMessage `json:"file,omitempty"`
+}
+
+// MessageContent 消息内容，兼容字符串和多段数组两种格式
+type MessageContent struct {
+	Text  string
+	Parts []ContentPart
+	Null  bool
+}
+
+// textContent 构造纯文本消息内容
+func textContent(s string) MessageContent {
+	return MessageContent{Text: s}
+}
+
+// UnmarshalJSON 同时接受字符串、片段数组和 null
+func (m *MessageContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*m = MessageContent{}
+
+	switch {
+	case len(data) == 0 || bytes.Equal(data, []byte("null")):
+		m.Null = true
+		return nil
+	case data[0] == '"':
+		return json.Unmarshal(data, &m.Text)
+	case data[0] == '[':
+		if err := json.Unmarshal(data, &m.Parts); err != nil {
+			return err
+		}
+		if m.Parts == nil {
+			m.Parts = []ContentPart{}
+		}
+		return nil
+	default:
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+}
+
+// MarshalJSON 片段数组原样输出，否则输出字符串
+func (m MessageContent) MarshalJSON() ([]byte, error) {
+	if m.Parts != nil {
+		return json.Marshal(m.Parts)
+	}
+	if m.Null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(m.Text)
+}
+
+// ContentError 消息内容无法转发到上游时的错误
+type ContentError struct {
+	Param   string
+	Message string
+	Code    string
+}
+
+func (e *ContentError) Error() string {
+	return e.Message
+}
+
+// flatten 将消息内容展开为纯文本，遇到上游无法承载的片段类型时返回错误
+func (m MessageContent) flatten(param string) (string, error) {
+	if m.Parts == nil {
+		return m.Text, nil
+	}
+
+	texts := make([]string, 0, len(m.Parts))
+	for i, part := range m.Parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url", "input_audio", "file":
+			return "", &ContentError{
+				Param:   fmt.Sprintf("%s[%d]", param, i),
+				Message: fmt.Sprintf("Content part type '%s' is not supported by this model; only 'text' parts are accepted", part.Type),
+				Code:    "unsupported_content_type",
+			}
+		default:
+			return "", &ContentError{
+				Param:   fmt.Sprintf("%s[%d].type", param, i),
+				Message: fmt.Sprintf("Invalid content part type: '%s'", part.Type),
+				Code:    "invalid_content_type",
+			}
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// 系统提示注入策略。TalkAI 的消息历史只有用户和助手两种角色，系统提示需要合并到某个用户轮次中
+const (
+	// systemLastUser 合并到最后一个用户轮次之前（默认），模型最容易遵循离当前最近的指令
+	systemLastUser = "last_user"
+	// systemFirstUser 合并到第一个用户轮次之前，多轮对话中前缀保持不变
+	systemFirstUser = "first_user"
+	// systemPseudoTurn 作为对话开头的一个独立用户轮次，后面跟一条助手的确认回复
+	systemPseudoTurn = "pseudo_turn"
+)
+
+// systemAcknowledgement 独立的系统提示轮次之后的助手回复，避免出现连续的两个用户轮次
+const systemAcknowledgement = "Understood. I will follow these instructions."
+
+// validSystemStrategy 判断系统提示注入策略名称是否有效
+func validSystemStrategy(name string) bool {
+	switch name {
+	case systemLastUser, systemFirstUser, systemPseudoTurn:
+		return true
+	}
+	return false
+}
+
+// injectSystemPrompt 按策略将系统提示合并到消息历史中，工具结果同样是用户轮次。
+// 没有用户轮次时（例如只有助手消息），无论哪种策略都插入为开头的独立轮次。
+// 独立轮次之后是用户消息时插入一条助手的确认回复，保持用户和助手交替
+func injectSystemPrompt(history []TalkAIMessage, systemPrompt string, strategy string) []TalkAIMessage {
+	if systemPrompt == "" {
+		return history
+	}
+
+	target := -1
+	for i, msg := range history {
+		if msg.From != "you" {
+			continue
+		}
+		if strategy == systemLastUser || (strategy == systemFirstUser && target < 0) {
+			target = i
+		}
+	}
+	if target < 0 {
+		turns := []TalkAIMessage{{ID: uuid.New().String(), From: "you", Content: systemPrompt, system: true}}
+		if len(history) > 0 && history[0].From == "you" {
+			turns = append(turns, TalkAIMessage{ID: uuid.New().String(), From: "assistant", Content: systemAcknowledgement, system: true})
+		}
+		return append(turns, history...)
+	}
+	history[target].Content = systemPrompt + "\n\n" + history[target].Content
+	history[target].system = true
+	return history
+}
+
+// builtinRoles OpenAI 消息的内置角色，按顺序用于错误提示
+var builtinRoles = []string{"system", "developer", "user", "assistant", "tool", "function"}
+
+// isBuiltinRole 判断是否为内置角色
+func isBuiltinRole(role string) bool {
+	for _, builtin := range builtinRoles {
+		if role == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// validRoleTarget 判断 ROLE_MAP 中的目标角色是否有效，自定义角色只能映射为 system、user 或 assistant
+func validRoleTarget(role string) bool {
+	switch role {
+	case "system", "user", "assistant":
+		return true
+	}
+	return false
+}
+
+// resolveMessageRole 返回消息按哪种内置角色处理，以及显示在内容前的发言者标签。
+// 自定义角色按 ROLE_MAP 映射，没有 name 时以角色名作为标签；无法识别的角色返回错误，不再静默丢弃
+func resolveMessageRole(msg ChatMessage, index int) (string, string, error) {
+	if isBuiltinRole(msg.Role) {
+		return msg.Role, msg.Name, nil
+	}
+	if mapped, ok := config.RoleMap[msg.Role]; ok {
+		label := msg.Name
+		if label == "" {
+			label = msg.Role
+		}
+		return mapped, label, nil
+	}
+
+	custom := make([]string, 0, len(config.RoleMap))
+	for role := range config.RoleMap {
+		custom = append(custom, role)
+	}
+	sort.Strings(custom)
+	supported := append(append([]string{}, builtinRoles...), custom...)
+	return "", "", &ContentError{
+		Param:   fmt.Sprintf("messages[%d].role", index),
+		Code:    "invalid_value",
+		Message: fmt.Sprintf("messages[%d].role: invalid value '%s'. Supported values are: '%s'.", index, msg.Role, strings.Join(supported, "', '")),
+	}
+}
+
+// speakerLabel 在多人对话中用 "名称: 内容" 标出发言者，NAME_LABELS 关闭或没有标签时原样返回
+func speakerLabel(label, content string) string {
+	if !config.NameLabels || label == "" {
+		return content
+	}
+	return label + ": " + content
+}
+
+// buildMessagesHistory 将 OpenAI 消息列表转换为 TalkAI 消息历史。所有 system 和 developer 消息
+// 不论出现在什么位置，都按顺序合并为一个系统提示，instructions 为代理额外注入的说明（如工具定义），
+// 追加在系统提示之后，再按模型的注入策略合并到历史中。用户和助手消息的 name 显示为发言者标签，
+// 无法识别的角色返回 400 错误
+func buildMessagesHistory(messages []ChatMessage, model string, instructions ...string) ([]TalkAIMessage, error) {
+	messagesHistory := []TalkAIMessage{}
+	systemParts := []string{}
+	toolNames := make(map[string]string)
+
+	appendMessage := func(from, content string) {
+		messagesHistory = append(messagesHistory, TalkAIMessage{
+			ID:      uuid.New().String(),
+			From:    from,
+			Content: content,
+		})
+	}
+
+	lastToolResult := false
+	for i, msg := range messages {
+		content, err := msg.Content.flatten(fmt.Sprintf("messages[%d].content", i))
+		if err != nil {
+			return nil, err
+		}
+
+		role, label, err := resolveMessageRole(msg, i)
+		if err != nil {
+			return nil, err
+		}
+
+		isToolResult := false
+		switch role {
+		case "system", "developer":
+			if strings.TrimSpace(content) != "" {
+				systemParts = append(systemParts, content)
+			}
+		case "user":
+			appendMessage("you", speakerLabel(label, content))
+		case "assistant":
+			parts := []string{}
+			if strings.TrimSpace(content) != "" {
+				parts = append(parts, speakerLabel(label, content))
+			}
+			for _, call := range msg.ToolCalls {
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, renderToolCall(call.Function))
+			}
+			if msg.FunctionCall != nil {
+				parts = append(parts, renderToolCall(*msg.FunctionCall))
+			}
+			appendMessage("assistant", strings.Join(parts, "\n"))
+		case "tool", "function":
+			// 工具结果作为用户轮次回传，连续的结果合并为一条
+			name := msg.Name
+			if name == "" {
+				name = toolNames[msg.ToolCallID]
+			}
+			result := renderToolResult(name, msg.ToolCallID, content)
+			if lastToolResult {
+				last := &messagesHistory[len(messagesHistory)-1]
+				last.Content = last.Content + "\n" + result
+			} else {
+				appendMessage("you", result)
+			}
+			isToolResult = true
+		}
+		lastToolResult = isToolResult
+	}
+
+	for _, instruction := range instructions {
+		if instruction != "" {
+			systemParts = append(systemParts, instruction)
+		}
+	}
+	systemPrompt := strings.Join(systemParts, "\n\n")
+	messagesHistory = injectSystemPrompt(messagesHistory, systemPrompt, systemStrategyFor(model))
+
+	return messagesHistory, nil
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OllamaToolCall Ollama 工具调用，arguments 为 JSON 对象而不是字符串
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// OllamaMessage Ollama 消息结构
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// OllamaOptions Ollama 模型参数，只使用代理能执行的部分，其余忽略
+type OllamaOptions struct {
+	Temperature *float64      `json:"temperature,omitempty"`
+	NumPredict  *int          `json:"num_predict,omitempty"`
+	Stop        StopSequences `json:"stop,omitempty"`
+}
+
+// OllamaChatRequest /api/chat 请求结构
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"`
+	Options  *OllamaOptions  `json:"options,omitempty"`
+	Stream   *bool           `json:"stream,omitempty"`
+	// PromptTemplate 扩展字段，引用服务端的提示词模板
+	PromptTemplate *PromptTemplateRef `json:"prompt_template,omitempty"`
+}
+
+// OllamaGenerateRequest /api/generate 请求结构
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix,omitempty"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	// PromptTemplate 扩展字段，引用服务端的提示词模板
+	PromptTemplate *PromptTemplateRef `json:"prompt_template,omitempty"`
+}
+
+// ollamaParams Ollama 请求转换后的公共参数
+type ollamaParams struct {
+	Model     string // 请求中的模型名，原样返回给客户端
+	Stream    bool
+	Format    *ResponseFormat
+	Tools     *toolSettings
+	Stops     []string
+	MaxTokens int
+}
+
+// ollamaModelName 返回模型在 Ollama 接口中的名称
+func ollamaModelName(id string) string {
+	return id + ":latest"
+}
+
+// resolveOllamaModel 将 Ollama 模型名转换为 TalkAI 模型 ID，找不到时原样使用
+func resolveOllamaModel(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ":latest")
+	for displayName, id := range modelsMap {
+		if name == id || name == displayName {
+			return id, true
+		}
+	}
+	return name, false
+}
+
+// ollamaFormat 将 format 参数转换为 response_format："json" 或 JSON schema 对象
+func ollamaFormat(raw json.RawMessage) (*ResponseFormat, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) || bytes.Equal(raw, []byte(`""`)) {
+		return nil, nil
+	}
+	if bytes.Equal(raw, []byte(`"json"`)) {
+		return &ResponseFormat{Type: "json_object"}, nil
+	}
+	if raw[0] != '{' {
+		return nil, fmt.Errorf("format must be \"json\" or a JSON schema object")
+	}
+	f := &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "response", Schema: raw}}
+	if err := validateResponseFormat(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// applyOllamaOptions 应用 options 中的温度、停止序列和 num_predict
+func applyOllamaOptions(p *ollamaParams, options *OllamaOptions, talkAIReq *TalkAIRequest) error {
+	if options == nil {
+		return nil
+	}
+	if options.Temperature != nil {
+		talkAIReq.Settings["temperature"] = *options.Temperature
+	}
+	if len(options.Stop) > maxStopSequences {
+		return fmt.Errorf("options.stop: at most %d stop sequences are allowed", maxStopSequences)
+	}
+	p.Stops = options.Stop
+	// num_predict 为负数表示不限制
+	if options.NumPredict != nil && *options.NumPredict > 0 {
+		p.MaxTokens = *options.NumPredict
+	}
+	return nil
+}
+
+// ollamaToChatMessages 将 Ollama 消息转换为 OpenAI 消息，复用同一套历史构建逻辑
+func ollamaToChatMessages(messages []OllamaMessage) ([]ChatMessage, error) {
+	result := make([]ChatMessage, 0, len(messages))
+	for i, msg := range messages {
+		if len(msg.Images) > 0 {
+			return nil, fmt.Errorf("messages[%d].images: images are not supported by this model", i)
+		}
+		chatMsg := ChatMessage{Role: msg.Role, Content: textContent(msg.Content)}
+		switch msg.Role {
+		case "system", "user":
+		case "assistant":
+			for _, call := range msg.ToolCalls {
+				arguments := string(bytes.TrimSpace(call.Function.Arguments))
+				if arguments == "" || arguments == "null" {
+					arguments = "{}"
+				}
+				chatMsg.ToolCalls = append(chatMsg.ToolCalls, ToolCall{
+					ID:       newToolCallID(),
+					Type:     "function",
+					Function: FunctionCall{Name: call.Function.Name, Arguments: arguments},
+				})
+			}
+		case "tool":
+			chatMsg.Name = msg.ToolName
+		default:
+			// ROLE_MAP 中的自定义角色由 buildMessagesHistory 处理
+			if _, ok := config.RoleMap[msg.Role]; !ok {
+				return nil, fmt.Errorf("messages[%d].role: unexpected role '%s'", i, msg.Role)
+			}
+		}
+		result = append(result, chatMsg)
+	}
+	return result, nil
+}
+
+// ollamaToolCalls 将解析出的工具调用转换为 Ollama 格式
+func ollamaToolCalls(calls []ToolCall) []OllamaToolCall {
+	result := make([]OllamaToolCall, len(calls))
+	for i, call := range calls {
+		result[i].Function.Name = call.Function.Name
+		result[i].Function.Arguments = anthropicToolInput(call.Function.Arguments)
+	}
+	return result
+}
+
+func ollamaChat(c *gin.Context) {
+	startTime := time.Now()
+
+	var req OllamaChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 展开引用的提示词模板，模型名中的模板后缀不传给上游（Ollama 客户端可能在模板名后追加 :latest）
+	name, templatePrompt, err := resolvePromptTemplate(c, strings.TrimSuffix(req.Model, ":latest"), req.PromptTemplate)
+	if err != nil {
+		apiErr := requestAPIError(err, "prompt_template")
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	params := ollamaParams{Model: req.Model, Stream: req.Stream == nil || *req.Stream}
+	model, _ := resolveOllamaModel(name)
+
+	// 没有消息时与 Ollama 一致，直接返回表示模型已加载
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"model":       req.Model,
+			"created_at":  time.Now().UTC().Format(time.RFC3339Nano),
+			"message":     gin.H{"role": "assistant", "content": ""},
+			"done":        true,
+			"done_reason": "load",
+		})
+		trackRequest(c, startTime, http.StatusOK)
+		return
+	}
+
+	params.Tools, err = resolveToolSettings(&ChatCompletionRequest{Tools: req.Tools})
+	if err == nil {
+		params.Format, err = ollamaFormat(req.Format)
+	}
+	var messages []ChatMessage
+	if err == nil {
+		messages, err = ollamaToChatMessages(req.Messages)
+	}
+	// 与 Ollama 一致，末尾的助手消息作为回复的开头
+	messages, prefill := splitPrefill(prependSystemPrompt(messages, templatePrompt))
+	var history []TalkAIMessage
+	if err == nil {
+		history, err = buildMessagesHistory(messages, model, buildToolPrompt(params.Tools), buildResponseFormatPrompt(params.Format))
+		history = appendPrefillInstruction(history, prefill)
+	}
+	talkAIReq := TalkAIRequest{
+		Type:            "chat",
+		MessagesHistory: history,
+		Settings: map[string]interface{}{
+			"model":       model,
+			"temperature": config.DefaultTemp,
+		},
+		prefill: prefill,
+	}
+	if err == nil {
+		err = applyOllamaOptions(&params, req.Options, &talkAIReq)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	status := ollamaRespond(c, startTime, talkAIReq, params, func(content string, calls []OllamaToolCall) gin.H {
+		return gin.H{"message": OllamaMessage{Role: "assistant", Content: content, ToolCalls: calls}}
+	})
+	trackRequest(c, startTime, status)
+}
+
+func ollamaGenerate(c *gin.Context) {
+	startTime := time.Now()
+
+	var req OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 展开引用的提示词模板，模型名中的模板后缀不传给上游（Ollama 客户端可能在模板名后追加 :latest）
+	name, templatePrompt, err := resolvePromptTemplate(c, strings.TrimSuffix(req.Model, ":latest"), req.PromptTemplate)
+	if err != nil {
+		apiErr := requestAPIError(err, "prompt_template")
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	params := ollamaParams{Model: req.Model, Stream: req.Stream == nil || *req.Stream}
+	model, _ := resolveOllamaModel(name)
+
+	// prompt 为空时与 Ollama 一致，直接返回表示模型已加载
+	if req.Prompt == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"model":       req.Model,
+			"created_at":  time.Now().UTC().Format(time.RFC3339Nano),
+			"response":    "",
+			"done":        true,
+			"done_reason": "load",
+		})
+		trackRequest(c, startTime, http.StatusOK)
+		return
+	}
+
+	if len(req.Images) > 0 {
+		err = fmt.Errorf("images: images are not supported by this model")
+	}
+	if err == nil {
+		params.Format, err = ollamaFormat(req.Format)
+	}
+
+	// 带 suffix 时按补全处理，否则作为一轮普通对话
+	var history []TalkAIMessage
+	if err == nil {
+		if req.Suffix != "" {
+			history = []TalkAIMessage{buildCompletionMessage(req.Prompt, req.Suffix)}
+		} else {
+			messages := []ChatMessage{{Role: "user", Content: textContent(req.Prompt)}}
+			if req.System != "" {
+				messages = append([]ChatMessage{{Role: "system", Content: textContent(req.System)}}, messages...)
+			}
+			messages = prependSystemPrompt(messages, templatePrompt)
+			history, err = buildMessagesHistory(messages, model, buildResponseFormatPrompt(params.Format))
+		}
+	}
+	talkAIReq := TalkAIRequest{
+		Type:            "chat",
+		MessagesHistory: history,
+		Settings: map[string]interface{}{
+			"model":       model,
+			"temperature": config.DefaultTemp,
+		},
+	}
+	if err == nil {
+		err = applyOllamaOptions(&params, req.Options, &talkAIReq)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	status := ollamaRespond(c, startTime, talkAIReq, params, func(content string, calls []OllamaToolCall) gin.H {
+		return gin.H{"response": content}
+	})
+	trackRequest(c, startTime, status)
+}
+
+// ollamaRespond 请求上游并按 Ollama 格式输出，流式时为 NDJSON。
+// body 生成每一行中除公共字段以外的内容，返回写入的 HTTP 状态码
+func ollamaRespond(c *gin.Context, startTime time.Time, talkAIReq TalkAIRequest, p ollamaParams, body func(content string, calls []OllamaToolCall) gin.H) int {
+	model, _ := talkAIReq.Settings["model"].(string)
+	history, err := fitContext(c, talkAIReq.MessagesHistory, model, p.MaxTokens)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+		return apiErr.Status
+	}
+	talkAIReq.MessagesHistory = history
+	promptTokens := estimatePromptTokens(history)
+
+	line := func(content string, calls []OllamaToolCall, done bool) gin.H {
+		data := body(content, calls)
+		data["model"] = p.Model
+		data["created_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+		data["done"] = done
+		return data
+	}
+	final := func(finishReason string, evalCount int) gin.H {
+		data := line("", nil, true)
+		data["done_reason"] = finishReason
+		data["total_duration"] = time.Since(startTime).Nanoseconds()
+		data["load_duration"] = 0
+		data["prompt_eval_count"] = promptTokens
+		data["prompt_eval_duration"] = 0
+		data["eval_count"] = evalCount
+		data["eval_duration"] = time.Since(startTime).Nanoseconds()
+		return data
+	}
+
+	// JSON 模式需要先拿到完整输出进行校验
+	var content, finishReason string
+	var stream EventStream
+	if p.Format.jsonMode() {
+		content, finishReason, err = completeStructuredOutput(c.Request.Context(), talkAIReq, p.Format, p.Tools, p.Stops, p.MaxTokens)
+		if err != nil {
+			apiErr := upstreamAPIError(err)
+			c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+			return apiErr.Status
+		}
+		// 与 Ollama 一致，只返回回复开头之后的内容
+		content = strings.TrimPrefix(content, talkAIReq.prefill)
+	} else {
+		stream, err = openStream(c.Request.Context(), talkAIReq)
+		if err != nil {
+			apiErr := upstreamAPIError(err)
+			c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+			return apiErr.Status
+		}
+		defer stream.Close()
+	}
+
+	if !p.Stream {
+		if stream != nil {
+			limiter := newOutputLimiter(p.Stops, p.MaxTokens)
+			content, err = aggregateStreamContent(stream, limiter)
+			if err != nil {
+				apiErr := upstreamAPIError(err)
+				c.JSON(apiErr.Status, gin.H{"error": apiErr.Message})
+				return apiErr.Status
+			}
+			finishReason = limiter.FinishReason()
+		}
+		text := content
+		var calls []ToolCall
+		if p.Tools.enabled() {
+			text, calls = parseToolCalls(content, p.Tools)
+		}
+		data := final(finishReason, estimateTokens(content))
+		for k, v := range body(text, ollamaToolCalls(calls)) {
+			data[k] = v
+		}
+		c.JSON(http.StatusOK, data)
+		return http.StatusOK
+	}
+
+	// 读取上游出错时与 Ollama 一致，最后一行输出 {"error": ...}，不再发送 done 行
+	status := http.StatusOK
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Stream(func(w io.Writer) bool {
+		writeLine := func(data gin.H) {
+			jsonData, _ := json.Marshal(data)
+			w.Write(jsonData)
+			w.Write([]byte("\n"))
+			w.(http.Flusher).Flush()
+		}
+
+		// 工具调用在参数完整后一次性输出，与 Ollama 行为一致
+		var parser *toolCallParser
+		if p.Tools.enabled() {
+			parser = newToolCallParser(p.Tools)
+		}
+		var calls []ToolCall
+		handleEvents := func(events []toolEvent) {
+			for _, ev := range events {
+				switch ev.Kind {
+				case toolEventText:
+					writeLine(line(ev.Text, nil, false))
+				case toolEventStart:
+					calls = append(calls, ToolCall{ID: ev.ID, Type: "function", Function: FunctionCall{Name: ev.Name}})
+				case toolEventArgs:
+					calls[len(calls)-1].Function.Arguments += ev.Text
+				}
+			}
+		}
+
+		var counter tokenCounter
+		send := func(text string) {
+			if text == "" {
+				return
+			}
+			counter.Add(text)
+			if parser != nil {
+				handleEvents(parser.Feed(text))
+			} else {
+				writeLine(line(text, nil, false))
+			}
+		}
+
+		if stream != nil {
+			limiter := newOutputLimiter(p.Stops, p.MaxTokens)
+			err := forEachStreamChunk(stream, func(chunk string) bool {
+				out, done := limiter.Feed(chunk)
+				send(out)
+				return !done
+			})
+			if err != nil {
+				apiErr := upstreamAPIError(err)
+				status = apiErr.Status
+				writeLine(gin.H{"error": apiErr.Message})
+				return false
+			}
+			send(limiter.Flush())
+			finishReason = limiter.FinishReason()
+		} else {
+			send(content)
+		}
+		if parser != nil {
+			handleEvents(parser.Flush())
+		}
+		if len(calls) > 0 {
+			writeLine(line("", ollamaToolCalls(calls), false))
+		}
+
+		writeLine(final(finishReason, counter.Count()))
+		return false
+	})
+	return status
+}
+
+// ollamaModelDetails 模型详情，TalkAI 模型没有本地文件信息，只填写模型系列
+func ollamaModelDetails() gin.H {
+	return gin.H{
+		"parent_model":       "",
+		"format":             "",
+		"family":             "claude",
+		"families":           []string{"claude"},
+		"parameter_size":     "",
+		"quantization_level": "",
+	}
+}
+
+func ollamaTags(c *gin.Context) {
+	modifiedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	models := []gin.H{}
+	for _, id := range modelsMap {
+		digest := sha256.Sum256([]byte(id))
+		models = append(models, gin.H{
+			"name":        ollamaModelName(id),
+			"model":       ollamaModelName(id),
+			"modified_at": modifiedAt,
+			"size":        0,
+			"digest":      hex.EncodeToString(digest[:]),
+			"details":     ollamaModelDetails(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+func ollamaShow(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+	if _, ok := resolveOllamaModel(name); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"modelfile":    "",
+		"parameters":   "",
+		"template":     "",
+		"details":      ollamaModelDetails(),
+		"model_info":   gin.H{},
+		"capabilities": []string{"completion", "tools"},
+		"modified_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// 助手回复开头（prefill）：消息列表以助手消息结尾时，把它作为回复已经写好的开头，
+// 要求模型从它的结尾继续输出。TalkAI 没有原生的续写功能，开头会转换为最后一个用户轮次中的说明
+
+// splitPrefill 取出末尾的助手消息作为回复开头，返回剩余的消息和开头文本。
+// 带工具调用或内容为空的助手消息不作为开头，原样保留
+func splitPrefill(messages []ChatMessage) ([]ChatMessage, string) {
+	if len(messages) == 0 {
+		return messages, ""
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || len(last.ToolCalls) > 0 || last.FunctionCall != nil {
+		return messages, ""
+	}
+	text, err := last.Content.flatten("")
+	if err != nil || strings.TrimSpace(text) == "" {
+		return messages, ""
+	}
+	return messages[:len(messages)-1], text
+}
+
+// prefillInstruction 要求模型续写开头的说明
+func prefillInstruction(prefill string) string {
+	return "Your reply has already been started with the text in <prefill> below. " +
+		"Continue writing from exactly where it stops: output only the continuation, do not repeat the given text " +
+		"and do not add any introduction or commentary.\n\n<prefill>\n" + prefill + "\n</prefill>"
+}
+
+// appendPrefillInstruction 将续写说明追加到最后一个用户轮次的末尾，最后一条不是用户消息时新增一个用户轮次
+func appendPrefillInstruction(history []TalkAIMessage, prefill string) []TalkAIMessage {
+	if prefill == "" {
+		return history
+	}
+	if n := len(history); n > 0 && history[n-1].From == "you" {
+		history[n-1].Content = history[n-1].Content + "\n\n" + prefillInstruction(prefill)
+		return history
+	}
+	return append(history, TalkAIMessage{ID: uuid.New().String(), From: "you", Content: prefillInstruction(prefill)})
+}
+
+// prefillStream 模型有时仍会先重复一遍开头，这里去掉输出开头与 prefill 相同的部分。
+// 在确定输出是否以 prefill 开头之前先缓存内容，之后的事件原样透传
+type prefillStream struct {
+	EventStream
+	prefill  string
+	trimRest bool
+	pending  string
+	checked  bool
+	err      error
+}
+
+// newPrefillStream 包装事件流，prefill 只有空白时不做处理
+func newPrefillStream(stream EventStream, prefill string) EventStream {
+	trimmed := strings.TrimSpace(prefill)
+	if trimmed == "" {
+		return stream
+	}
+	return &prefillStream{
+		EventStream: stream,
+		prefill:     trimmed,
+		trimRest:    strings.TrimRight(prefill, " \t\r\n") != prefill,
+	}
+}
+
+func (s *prefillStream) Next() (StreamEvent, error) {
+	if s.err != nil {
+		return StreamEvent{}, s.err
+	}
+	if s.checked {
+		return s.EventStream.Next()
+	}
+	for {
+		ev, err := s.EventStream.Next()
+		if err != nil {
+			// 输出在确定之前结束，返回缓存中去掉重复开头后的内容，下次调用再返回错误
+			s.checked = true
+			text, _ := s.strip(true)
+			if text == "" {
+				return StreamEvent{}, err
+			}
+			s.err = err
+			return StreamEvent{Type: StreamEventText, Text: text}, nil
+		}
+		if ev.Type != StreamEventText {
+			return ev, nil
+		}
+
+		s.pending += ev.Text
+		if text, ok := s.strip(false); ok {
+			s.checked = true
+			return StreamEvent{Type: StreamEventText, Text: text}, nil
+		}
+	}
+}
+
+// strip 判断缓存的输出是否以 prefill 开头，是则去掉。还不能确定时返回 false，final 为 true 时总是给出结果
+func (s *prefillStream) strip(final bool) (string, bool) {
+	text := strings.TrimLeft(s.pending, " \t\r\n")
+	if !strings.HasPrefix(text, s.prefill) {
+		if !final && strings.HasPrefix(s.prefill, text) {
+			return "", false
+		}
+		return s.pending, true
+	}
+	rest := text[len(s.prefill):]
+	if s.trimRest {
+		// prefill 以空白结尾时，续写开头的空白已经包含在 prefill 中
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" && !final {
+			return "", false
+		}
+	}
+	return rest, true
+}
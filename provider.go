@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamEventType 上游流式事件类型
+type StreamEventType int
+
+const (
+	// StreamEventText 一段模型输出文本
+	StreamEventText StreamEventType = iota
+)
+
+// StreamEvent provider 解码后的上游流式事件
+type StreamEvent struct {
+	Type StreamEventType
+	Text string
+}
+
+// EventStream 上游响应的事件流。Next 在流结束时返回 io.EOF；
+// Close 可以在读完之前调用，用于提前断开上游连接
+type EventStream interface {
+	Next() (StreamEvent, error)
+	Close() error
+}
+
+// Provider 上游服务提供方：把统一的 TalkAIRequest 转换为自己的请求格式并发送，
+// 再把响应解码为 EventStream。上游返回非 200 状态码时返回 UpstreamStatusError。
+// ctx 取消（客户端断开）时应中止请求，并让 EventStream 的 Next 返回错误。
+// u 为负载均衡选中的上游端点，provider 没有在 upstreams 中配置端点时为 nil
+type Provider interface {
+	Name() string
+	Stream(ctx context.Context, u *upstream, req TalkAIRequest) (EventStream, error)
+}
+
+// ModelConfig models.json 中的模型配置，值可以是模型 ID 字符串，也可以是
+// {"id", "provider", "balance", "system_strategy", "context_window", "context_strategy"} 对象
+type ModelConfig struct {
+	ID              string `json:"id"`
+	Provider        string `json:"provider,omitempty"`
+	Balance         string `json:"balance,omitempty"`
+	SystemStrategy  string `json:"system_strategy,omitempty"`
+	ContextWindow   *int   `json:"context_window,omitempty"`
+	ContextStrategy string `json:"context_strategy,omitempty"`
+}
+
+// UnmarshalJSON 同时接受字符串和对象
+func (m *ModelConfig) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		*m = ModelConfig{}
+		return json.Unmarshal(data, &m.ID)
+	}
+	type plain ModelConfig
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("model entry must be a string or an object with id, provider, balance, system_strategy, context_window and context_strategy")
+	}
+	*m = ModelConfig(p)
+	return nil
+}
+
+// UpstreamStatusError 上游返回了非 200 状态码，RetryAfter 为上游 Retry-After 头要求的等待时间，
+// Detail 为响应内容摘要（HTML 页面只保留标题），Challenge 表示响应是 Cloudflare 等反爬验证页
+type UpstreamStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Detail     string
+	Challenge  bool
+}
+
+func (e *UpstreamStatusError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("TalkAI API error: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("TalkAI API error: status %d: %s", e.StatusCode, e.Detail)
+}
+
+// StreamReadError 上游已经返回 200，读取事件流的过程中出错（连接中断、上游发送 error 事件等）
+type StreamReadError struct {
+	Err error
+}
+
+func (e *StreamReadError) Error() string {
+	return fmt.Sprintf("upstream stream interrupted: %v", e.Err)
+}
+
+func (e *StreamReadError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// maxUpstreamErrorBody 读取上游错误响应的最大字节数
+	maxUpstreamErrorBody = 8 << 10
+	// maxUpstreamErrorDetail 错误信息中保留的响应内容字符数
+	maxUpstreamErrorDetail = 300
+)
+
+// challengeMarkers 反爬验证页中常见的特征（小写）
+var challengeMarkers = []string{
+	"cf-chl", "challenge-platform", "just a moment", "attention required",
+	"cf-browser-verification", "captcha", "ddos-guard",
+}
+
+var htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// newUpstreamStatusError 读取上游的错误响应并生成 UpstreamStatusError，调用方负责关闭响应体
+func newUpstreamStatusError(resp *http.Response) *UpstreamStatusError {
+	e := &UpstreamStatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+	text := strings.TrimSpace(string(body))
+
+	if isHTMLResponse(resp, text) {
+		e.Detail = "HTML page"
+		if m := htmlTitlePattern.FindStringSubmatch(text); m != nil {
+			if title := strings.Join(strings.Fields(m[1]), " "); title != "" {
+				e.Detail = fmt.Sprintf("HTML page %q", title)
+			}
+		}
+	} else {
+		e.Detail = strings.Join(strings.Fields(text), " ")
+		if runes := []rune(e.Detail); len(runes) > maxUpstreamErrorDetail {
+			e.Detail = string(runes[:maxUpstreamErrorDetail]) + "..."
+		}
+	}
+	e.Challenge = isChallengeResponse(resp, body)
+	return e
+}
+
+// isHTMLResponse 判断错误响应是否为 HTML 页面，text 为去掉首尾空白的响应内容
+func isHTMLResponse(resp *http.Response, text string) bool {
+	lower := strings.ToLower(text)
+	return strings.Contains(resp.Header.Get("Content-Type"), "text/html") ||
+		strings.HasPrefix(lower, "<!doctype html") || strings.HasPrefix(lower, "<html")
+}
+
+// isChallengeResponse 判断错误响应是否为 Cloudflare 等反爬验证页，body 为已读取的响应内容
+func isChallengeResponse(resp *http.Response, body []byte) bool {
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	}
+	text := strings.TrimSpace(string(body))
+	if !isHTMLResponse(resp, text) {
+		return false
+	}
+	lower := strings.ToLower(text)
+	for _, marker := range challengeMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekErrorBody 读取错误响应的开头部分用于判断，读取的内容会放回响应体，之后仍可完整读取
+func peekErrorBody(resp *http.Response) []byte {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return body
+}
+
+// defaultProviderName 未在 models.json 中指定 provider 的模型使用 TalkAI
+const defaultProviderName = "talkai"
+
+var (
+	providers      = make(map[string]Provider)
+	modelProviders = make(map[string]string)
+	modelBalance   = make(map[string]string)
+	modelSystem    = make(map[string]string)
+	modelContext   = make(map[string]contextLimit)
+	providersMutex sync.RWMutex
+)
+
+// registerProvider 注册 provider，同名时覆盖
+func registerProvider(p Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	providers[p.Name()] = p
+}
+
+// providerForModel 返回服务该模型的 provider
+func providerForModel(model string) (Provider, error) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	name := modelProviders[model]
+	if name == "" {
+		name = defaultProviderName
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("provider '%s' for model '%s' is not registered", name, model)
+	}
+	return p, nil
+}
+
+// balanceStrategyFor 返回模型使用的负载均衡策略，未在 models.json 中指定时使用 UPSTREAM_BALANCE
+func balanceStrategyFor(model string) string {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	if strategy := modelBalance[model]; strategy != "" {
+		return strategy
+	}
+	return config.UpstreamBalance
+}
+
+// systemStrategyFor 返回模型使用的系统提示注入策略，未在 models.json 中指定时使用 SYSTEM_STRATEGY
+func systemStrategyFor(model string) string {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	if strategy := modelSystem[model]; strategy != "" {
+		return strategy
+	}
+	return config.SystemStrategy
+}
+
+// contextLimit models.json 中为模型单独指定的上下文窗口和策略，未指定的字段使用全局配置
+type contextLimit struct {
+	Window   *int
+	Strategy string
+}
+
+// contextLimitFor 返回模型的上下文窗口（token 数，0 表示不限制）和超长时的处理策略，
+// 未在 models.json 中指定时使用 CONTEXT_WINDOW 和 CONTEXT_STRATEGY
+func contextLimitFor(model string) (int, string) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	window, strategy := config.ContextWindow, config.ContextStrategy
+	if limit, ok := modelContext[model]; ok {
+		if limit.Window != nil {
+			window = *limit.Window
+		}
+		if limit.Strategy != "" {
+			strategy = limit.Strategy
+		}
+	}
+	return window, strategy
+}
+
+// openStream 按请求中的模型选择 provider 并发起请求，上游请求随 ctx 一起取消。
+// 请求带有回复开头时，输出中重复的开头会被去掉
+func openStream(ctx context.Context, req TalkAIRequest) (EventStream, error) {
+	model, _ := req.Settings["model"].(string)
+	p, err := providerForModel(model)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := streamWithRetry(ctx, p, model, req)
+	if err != nil || req.prefill == "" {
+		return stream, err
+	}
+	return newPrefillStream(stream, req.prefill), nil
+}
+
+// forEachStreamChunk 逐条读取上游事件流中的文本片段，读完后关闭事件流。
+// emit 返回 false 时停止读取并立即关闭上游连接，不再等待剩余输出。
+// 正常结束和 emit 停止时返回 nil；客户端断开时返回 context 的错误，其他读取错误包装为 StreamReadError
+func forEachStreamChunk(stream EventStream, emit func(string) bool) error {
+	defer stream.Close()
+	for {
+		ev, err := stream.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				if config.DebugMode {
+					log.Printf("客户端已断开，停止读取上游响应")
+				}
+				return err
+			}
+			log.Printf("读取上游响应出错: %v", err)
+			return &StreamReadError{Err: err}
+		}
+		if ev.Type != StreamEventText || ev.Text == "" {
+			continue
+		}
+		if !emit(ev.Text) {
+			if config.DebugMode {
+				log.Printf("输出已达到限制，提前关闭上游连接")
+			}
+			return nil
+		}
+	}
+}
+
+// loadModelConfigs 解析 models.json，填充 modelsMap 和模型到 provider 的映射
+func loadModelConfigs(data []byte) error {
+	var entries map[string]ModelConfig
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	for name, entry := range entries {
+		if entry.ID == "" {
+			return fmt.Errorf("model '%s': id is required", name)
+		}
+		modelsMap[name] = entry.ID
+		if entry.Provider != "" {
+			modelProviders[entry.ID] = entry.Provider
+		}
+		if entry.Balance != "" {
+			if !validBalanceStrategy(entry.Balance) {
+				return fmt.Errorf("model '%s': unknown balance strategy '%s'", name, entry.Balance)
+			}
+			modelBalance[entry.ID] = entry.Balance
+		}
+		if entry.SystemStrategy != "" {
+			if !validSystemStrategy(entry.SystemStrategy) {
+				return fmt.Errorf("model '%s': unknown system strategy '%s'", name, entry.SystemStrategy)
+			}
+			modelSystem[entry.ID] = entry.SystemStrategy
+		}
+		if entry.ContextWindow != nil && *entry.ContextWindow < 0 {
+			return fmt.Errorf("model '%s': context_window must not be negative", name)
+		}
+		if entry.ContextStrategy != "" && !validContextStrategy(entry.ContextStrategy) {
+			return fmt.Errorf("model '%s': unknown context strategy '%s'", name, entry.ContextStrategy)
+		}
+		if entry.ContextWindow != nil || entry.ContextStrategy != "" {
+			modelContext[entry.ID] = contextLimit{Window: entry.ContextWindow, Strategy: entry.ContextStrategy}
+		}
+	}
+	return nil
+}
+
+// checkModelProviders 检查 models.json 引用的 provider 是否都已注册。
+// 各文件的 init 顺序不固定，需要在 main 中所有 provider 注册完成后调用
+func checkModelProviders() {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+	for model, name := range modelProviders {
+		if _, ok := providers[name]; !ok {
+			log.Printf("警告: 模型 %s 使用的 provider %s 未注册", model, name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// mockProvider 本地模拟上游，不发出网络请求，把最后一条用户消息回显为回复，
+// 用于在没有 TalkAI 访问权限时调试客户端。在 models.json 中把模型的 provider 设为 "mock" 即可使用
+type mockProvider struct{}
+
+func init() {
+	registerProvider(mockProvider{})
+}
+
+func (mockProvider) Name() string {
+	return "mock"
+}
+
+func (mockProvider) Stream(ctx context.Context, _ *upstream, req TalkAIRequest) (EventStream, error) {
+	last := ""
+	for i := len(req.MessagesHistory) - 1; i >= 0; i-- {
+		if req.MessagesHistory[i].From == "you" {
+			last = req.MessagesHistory[i].Content
+			break
+		}
+	}
+
+	// 按单词切分，模拟逐段输出
+	reply := "This is a mock response. You said: " + last
+	var chunks []string
+	for _, word := range strings.SplitAfter(reply, " ") {
+		if word != "" {
+			chunks = append(chunks, word)
+		}
+	}
+	return &mockStream{ctx: ctx, chunks: chunks}, nil
+}
+
+// errMockStreamClosed 关闭后继续读取，与读取已关闭的 HTTP 响应体一致返回错误
+var errMockStreamClosed = errors.New("mock stream closed")
+
+// mockStream 依次返回预先切分好的文本片段。Close 只设置标记，可以重复调用，
+// 也可以与另一个 goroutine 中的 Next 并发调用
+type mockStream struct {
+	ctx    context.Context
+	chunks []string
+	closed atomic.Bool
+}
+
+func (s *mockStream) Next() (StreamEvent, error) {
+	if err := s.ctx.Err(); err != nil {
+		return StreamEvent{}, err
+	}
+	if s.closed.Load() {
+		return StreamEvent{}, errMockStreamClosed
+	}
+	if len(s.chunks) == 0 {
+		return StreamEvent{}, io.EOF
+	}
+	text := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return StreamEvent{Type: StreamEventText, Text: text}, nil
+}
+
+func (s *mockStream) Close() error {
+	s.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// talkAIProvider TalkAI 上游，请求体即 TalkAIRequest，响应为 SSE 事件流
+type talkAIProvider struct{}
+
+func init() {
+	registerProvider(talkAIProvider{})
+}
+
+func (talkAIProvider) Name() string {
+	return "talkai"
+}
+
+func (p talkAIProvider) Stream(ctx context.Context, u *upstream, req TalkAIRequest) (EventStream, error) {
+	if u == nil {
+		return nil, fmt.Errorf("upstream '%s' is not configured", p.Name())
+	}
+	httpReq, err := p.buildRequest(ctx, u, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newUpstreamStatusError(resp)
+	}
+	return newTalkAIStream(resp.Body), nil
+}
+
+func (talkAIProvider) buildRequest(ctx context.Context, u *upstream, req TalkAIRequest) (*http.Request, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.BaseURL+"/chat/send/", strings.NewReader(string(jsonData)))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	httpReq.Header.Set("Accept", "application/json, text/event-stream")
+	httpReq.Header.Set("Content-Type", "application/json")
+	u.applyHeaders(httpReq)
+	return httpReq, nil
+}
+
+// talkAIStream 解码 TalkAI 的流式响应：每个 SSE 事件的 data 是一段文本，"-1" 为结束标记
+type talkAIStream struct {
+	body    io.ReadCloser
+	decoder *sseDecoder
+}
+
+func newTalkAIStream(body io.ReadCloser) *talkAIStream {
+	return &talkAIStream{body: body, decoder: newSSEDecoder(body)}
+}
+
+func (s *talkAIStream) Next() (StreamEvent, error) {
+	for {
+		event, err := s.decoder.Next()
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		if event.Event == "error" {
+			return StreamEvent{}, fmt.Errorf("TalkAI stream error: %s", event.Data)
+		}
+		if event.Data == "-1" {
+			return StreamEvent{}, io.EOF
+		}
+		if event.Data != "" {
+			return StreamEvent{Type: StreamEventText, Text: event.Data}, nil
+		}
+	}
+}
+
+func (s *talkAIStream) Close() error {
+	return s.body.Close()
+}
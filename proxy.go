@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyFailureThreshold 连续失败多少次后暂停使用该代理
+	proxyFailureThreshold = 3
+	// proxyCooldown 代理被标记为不可用后，经过多久重新尝试
+	proxyCooldown = 30 * time.Second
+)
+
+// proxyEntry 代理池中的一个出站代理，每个代理使用独立的长期客户端以复用连接
+type proxyEntry struct {
+	URL    *url.URL
+	client *http.Client
+
+	failures  int
+	downUntil time.Time
+	lastError string
+	requests  int64
+	errors    int64
+}
+
+// proxyPool 轮询使用的出站代理池。连续失败的代理在冷却期内被跳过，
+// 所有代理都不可用时选择最早恢复的一个，而不是直接失败
+type proxyPool struct {
+	entries []*proxyEntry
+	next    int
+	mutex   sync.Mutex
+}
+
+// ProxyStatus Dashboard 展示的代理状态，URL 中的密码已隐藏
+type ProxyStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"consecutive_failures"`
+	Requests  int64  `json:"requests"`
+	Errors    int64  `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// parseProxyURL 解析代理地址，支持 http、https、socks5 和 socks5h
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy '%s': %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy '%s': scheme must be http, https, socks5 or socks5h", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy '%s': missing host", raw)
+	}
+	return u, nil
+}
+
+// newProxyPool 创建代理池，没有配置代理时返回 nil（直连）
+func newProxyPool(rawURLs []string) (*proxyPool, error) {
+	var entries []*proxyEntry
+	for _, raw := range rawURLs {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		u, err := parseProxyURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &proxyEntry{URL: u, client: newUpstreamClient(newTransport(u))})
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &proxyPool{entries: entries}, nil
+}
+
+// Pick 选择下一个可用的代理，代理池为空时返回 nil
+func (p *proxyPool) Pick() *proxyEntry {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.entries); i++ {
+		entry := p.entries[(p.next+i)%len(p.entries)]
+		if !now.Before(entry.downUntil) {
+			p.next = (p.next + i + 1) % len(p.entries)
+			return entry
+		}
+	}
+
+	// 全部处于冷却期，选择最早恢复的代理
+	earliest := p.entries[0]
+	for _, entry := range p.entries[1:] {
+		if entry.downUntil.Before(earliest.downUntil) {
+			earliest = entry
+		}
+	}
+	return earliest
+}
+
+// Report 记录一次请求的结果，err 为 nil 表示代理工作正常
+func (p *proxyPool) Report(entry *proxyEntry, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry.requests++
+	if err == nil {
+		if entry.failures >= proxyFailureThreshold {
+			log.Printf("代理 %s 已恢复", entry.URL.Redacted())
+		}
+		entry.failures = 0
+		entry.downUntil = time.Time{}
+		return
+	}
+
+	entry.errors++
+	entry.failures++
+	entry.lastError = err.Error()
+	if entry.failures >= proxyFailureThreshold {
+		entry.downUntil = time.Now().Add(proxyCooldown)
+		log.Printf("代理 %s 连续失败 %d 次，暂停使用 %v: %v", entry.URL.Redacted(), entry.failures, proxyCooldown, err)
+	}
+}
+
+// Status 返回代理池中每个代理的状态
+func (p *proxyPool) Status() []ProxyStatus {
+	if p == nil {
+		return []ProxyStatus{}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	result := make([]ProxyStatus, 0, len(p.entries))
+	for _, entry := range p.entries {
+		result = append(result, ProxyStatus{
+			URL:       entry.URL.Redacted(),
+			Healthy:   !now.Before(entry.downUntil),
+			Failures:  entry.failures,
+			Requests:  entry.requests,
+			Errors:    entry.errors,
+			LastError: entry.lastError,
+		})
+	}
+	return result
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ResponsesInput input 参数，兼容字符串和输入项数组两种格式
+type ResponsesInput struct {
+	Text  string
+	Items []ResponsesInputItem
+}
+
+// ResponsesInputItem 输入项：消息、函数调用或函数调用结果
+type ResponsesInputItem struct {
+	Type      string          `json:"type,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Role      string          `json:"role,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    string          `json:"output,omitempty"`
+}
+
+// ResponsesTool Responses API 的函数工具定义（字段直接放在顶层）
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ResponsesRequest /v1/responses 请求结构
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponsesInput    `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Tools              []ResponsesTool   `json:"tools,omitempty"`
+	ToolChoice         json.RawMessage   `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	// PromptTemplate 扩展字段，引用服务端的提示词模板
+	PromptTemplate *PromptTemplateRef `json:"prompt_template,omitempty"`
+}
+
+// ResponsesOutputText 输出消息中的文本内容
+type ResponsesOutputText struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// ResponsesOutputItem 输出项：assistant 消息或函数调用
+type ResponsesOutputItem struct {
+	Type      string
+	ID        string
+	Status    string
+	Content   []ResponsesOutputText
+	CallID    string
+	Name      string
+	Arguments string
+}
+
+// ResponsesIncompleteDetails 响应未完成的原因
+type ResponsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponsesUsage Responses API 用量统计
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponsesResponse response 对象
+type ResponsesResponse struct {
+	ID                 string                      `json:"id"`
+	Object             string                      `json:"object"`
+	CreatedAt          int64                       `json:"created_at"`
+	Status             string                      `json:"status"`
+	Model              string                      `json:"model"`
+	Output             []ResponsesOutputItem       `json:"output"`
+	Instructions       *string                     `json:"instructions"`
+	PreviousResponseID *string                     `json:"previous_response_id"`
+	IncompleteDetails  *ResponsesIncompleteDetails `json:"incomplete_details"`
+	Error              interface{}                 `json:"error"`
+	MaxOutputTokens    *int                        `json:"max_output_tokens"`
+	Temperature        *float64                    `json:"temperature"`
+	Store              bool                        `json:"store"`
+	Metadata           map[string]string           `json:"metadata"`
+	Usage              *ResponsesUsage             `json:"usage"`
+}
+
+// storedResponse 保存的响应，Messages 为截至该响应（含其输出）的完整对话，不含 instructions
+type storedResponse struct {
+	Response ResponsesResponse
+	Messages []ChatMessage
+}
+
+// maxStoredResponses 内存中最多保存的响应数量，超出时淘汰最早的
+const maxStoredResponses = 1000
+
+var (
+	responseStore = make(map[string]*storedResponse)
+	responseOrder = []string{}
+	responseMutex sync.Mutex
+)
+
+// UnmarshalJSON 同时接受字符串和输入项数组
+func (in *ResponsesInput) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*in = ResponsesInput{}
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if data[0] == '"' {
+		return json.Unmarshal(data, &in.Text)
+	}
+	if data[0] == '[' {
+		return json.Unmarshal(data, &in.Items)
+	}
+	return fmt.Errorf("input must be a string or an array of input items")
+}
+
+// MarshalJSON 按输出项类型输出对应的字段
+func (item ResponsesOutputItem) MarshalJSON() ([]byte, error) {
+	if item.Type == "function_call" {
+		return json.Marshal(gin.H{
+			"type":      item.Type,
+			"id":        item.ID,
+			"status":    item.Status,
+			"call_id":   item.CallID,
+			"name":      item.Name,
+			"arguments": item.Arguments,
+		})
+	}
+	content := item.Content
+	if content == nil {
+		content = []ResponsesOutputText{}
+	}
+	return json.Marshal(gin.H{
+		"type":    item.Type,
+		"id":      item.ID,
+		"status":  item.Status,
+		"role":    "assistant",
+		"content": content,
+	})
+}
+
+// responsesContentText 提取输入消息内容中的文本，content 可以是字符串或内容部分数组
+func responsesContentText(raw json.RawMessage, param string) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var text string
+		err := json.Unmarshal(raw, &text)
+		return text, err
+	}
+
+	var parts []struct {
+		Type    string `json:"type"`
+		Text    string `json:"text"`
+		Refusal string `json:"refusal"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("%s: content must be a string or an array of content parts", param)
+	}
+	texts := make([]string, 0, len(parts))
+	for i, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		default:
+			p := fmt.Sprintf("%s[%d]", param, i)
+			return "", &ContentError{
+				Param:   p,
+				Message: fmt.Sprintf("%s: content part type '%s' is not supported by this model", p, part.Type),
+				Code:    "unsupported_content_type",
+			}
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// responsesInputToChatMessages 将输入项转换为 OpenAI 消息，复用同一套历史构建逻辑
+func responsesInputToChatMessages(input ResponsesInput) ([]ChatMessage, error) {
+	if input.Items == nil {
+		if input.Text == "" {
+			return nil, nil
+		}
+		return []ChatMessage{{Role: "user", Content: textContent(input.Text)}}, nil
+	}
+
+	messages := []ChatMessage{}
+	for i, item := range input.Items {
+		param := fmt.Sprintf("input[%d]", i)
+		switch item.Type {
+		case "", "message":
+			text, err := responsesContentText(item.Content, param+".content")
+			if err != nil {
+				return nil, err
+			}
+			role := item.Role
+			switch role {
+			case "user", "assistant", "system":
+			case "developer":
+				role = "system"
+			default:
+				return nil, fmt.Errorf("%s.role: unexpected role '%s'", param, item.Role)
+			}
+			messages = append(messages, ChatMessage{Role: role, Content: textContent(text)})
+		case "function_call":
+			if item.Name == "" {
+				return nil, fmt.Errorf("%s.name is required", param)
+			}
+			arguments := item.Arguments
+			if arguments == "" {
+				arguments = "{}"
+			}
+			call := ToolCall{ID: item.CallID, Type: "function", Function: FunctionCall{Name: item.Name, Arguments: arguments}}
+			// 连续的函数调用合并到同一条 assistant 消息中
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, ChatMessage{Role: "assistant", ToolCalls: []ToolCall{call}})
+			}
+		case "function_call_output":
+			messages = append(messages, ChatMessage{Role: "tool", ToolCallID: item.CallID, Content: textContent(item.Output)})
+		case "reasoning":
+			// 推理内容不回传给上游
+		default:
+			return nil, &ContentError{
+				Param:   param,
+				Message: fmt.Sprintf("%s: input item type '%s' is not supported", param, item.Type),
+				Code:    "unsupported_input_type",
+			}
+		}
+	}
+	return messages, nil
+}
+
+// responsesToolSettings 将 Responses API 的工具定义转换为工具调用模拟设置
+func responsesToolSettings(req *ResponsesRequest) (*toolSettings, error) {
+	chatReq := ChatCompletionRequest{ToolChoice: req.ToolChoice, ParallelToolCalls: req.ParallelToolCalls}
+	for i, tool := range req.Tools {
+		if tool.Type != "function" {
+			return nil, fmt.Errorf("tools[%d].type: unsupported tool type '%s'", i, tool.Type)
+		}
+		chatReq.Tools = append(chatReq.Tools, Tool{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return resolveToolSettings(&chatReq)
+}
+
+// outputToChatMessage 将输出项转换为 assistant 消息，供后续 previous_response_id 续接
+func outputToChatMessage(output []ResponsesOutputItem) ChatMessage {
+	msg := ChatMessage{Role: "assistant"}
+	texts := []string{}
+	for _, item := range output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				texts = append(texts, part.Text)
+			}
+		case "function_call":
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: FunctionCall{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	msg.Content = textContent(strings.Join(texts, ""))
+	return msg
+}
+
+// saveResponse 保存响应，超出容量时淘汰最早的响应
+func saveResponse(resp ResponsesResponse, messages []ChatMessage) {
+	responseMutex.Lock()
+	defer responseMutex.Unlock()
+
+	responseStore[resp.ID] = &storedResponse{Response: resp, Messages: messages}
+	responseOrder = append(responseOrder, resp.ID)
+	for len(responseOrder) > maxStoredResponses {
+		delete(responseStore, responseOrder[0])
+		responseOrder = responseOrder[1:]
+	}
+}
+
+// loadResponse 按 ID 查找保存的响应
+func loadResponse(id string) (*storedResponse, bool) {
+	responseMutex.Lock()
+	defer responseMutex.Unlock()
+	stored, ok := responseStore[id]
+	return stored, ok
+}
+
+func newResponseID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func createResponse(c *gin.Context) {
+	startTime := time.Now()
+
+	var req ResponsesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 展开引用的提示词模板
+	model, templatePrompt, err := resolvePromptTemplate(c, req.Model, req.PromptTemplate)
+	if err != nil {
+		apiErr := requestAPIError(err, "prompt_template")
+		writeAPIError(c, apiErr)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	req.Model = model
+
+	// 应用默认配置
+	if req.Model == "" {
+		req.Model = config.DefaultModel
+	}
+	if req.Temperature == nil {
+		req.Temperature = &config.DefaultTemp
+	}
+	store := req.Store == nil || *req.Store
+
+	tools, err := responsesToolSettings(&req)
+	if err == nil {
+		err = validateOutputLimits(nil, req.MaxOutputTokens)
+	}
+	if err != nil {
+		writeAPIError(c, requestAPIError(err, ""))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	// 续接之前的响应时，以保存的对话作为历史
+	conversation := []ChatMessage{}
+	if req.PreviousResponseID != "" {
+		previous, ok := loadResponse(req.PreviousResponseID)
+		if !ok {
+			writeAPIError(c, errNotFound("previous_response_id", "previous_response_not_found",
+				fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID)))
+			trackRequest(c, startTime, http.StatusNotFound)
+			return
+		}
+		conversation = append(conversation, previous.Messages...)
+	}
+
+	input, err := responsesInputToChatMessages(req.Input)
+	if err == nil && len(input) == 0 {
+		err = fmt.Errorf("input: at least one input item is required")
+	}
+	if err != nil {
+		writeAPIError(c, requestAPIError(err, "input"))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+	conversation = append(conversation, input...)
+
+	// instructions 只作用于当前响应，不会随 previous_response_id 续接
+	messages := conversation
+	if req.Instructions != "" {
+		messages = append([]ChatMessage{{Role: "system", Content: textContent(req.Instructions)}}, conversation...)
+	}
+	messagesHistory, err := buildMessagesHistory(prependSystemPrompt(messages, templatePrompt), req.Model, buildToolPrompt(tools))
+	if err != nil {
+		writeAPIError(c, requestAPIError(err, "input"))
+		trackRequest(c, startTime, http.StatusBadRequest)
+		return
+	}
+
+	maxTokens := 0
+	if req.MaxOutputTokens != nil {
+		maxTokens = *req.MaxOutputTokens
+	}
+	messagesHistory, err = fitContext(c, messagesHistory, req.Model, maxTokens)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		if apiErr.Param == "messages" {
+			apiErr.Param = "input"
+		}
+		writeAPIError(c, apiErr)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+
+	talkAIReq := TalkAIRequest{
+		Type:            "chat",
+		MessagesHistory: messagesHistory,
+		Settings: map[string]interface{}{
+			"model":       req.Model,
+			"temperature": req.Temperature,
+		},
+	}
+
+	stream, err := openStream(c.Request.Context(), talkAIReq)
+	if err != nil {
+		apiErr := upstreamAPIError(err)
+		writeAPIError(c, apiErr)
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+	defer stream.Close()
+
+	response := ResponsesResponse{
+		ID:              newResponseID("resp_"),
+		Object:          "response",
+		CreatedAt:       time.Now().Unix(),
+		Status:          "in_progress",
+		Model:           req.Model,
+		Output:          []ResponsesOutputItem{},
+		MaxOutputTokens: req.MaxOutputTokens,
+		Temperature:     req.Temperature,
+		Store:           store,
+		Metadata:        req.Metadata,
+	}
+	if req.Instructions != "" {
+		response.Instructions = &req.Instructions
+	}
+	if req.PreviousResponseID != "" {
+		response.PreviousResponseID = &req.PreviousResponseID
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+
+	limiter := newOutputLimiter(nil, maxTokens)
+	inputTokens := estimatePromptTokens(messagesHistory)
+	if req.Stream {
+		err = streamResponse(c, stream, &response, tools, limiter, inputTokens)
+	} else {
+		err = writeResponse(c, stream, &response, tools, limiter, inputTokens)
+	}
+	if err != nil {
+		// 流式响应已经发送了 response.failed 事件，失败的响应不保存
+		apiErr := upstreamAPIError(err)
+		if !req.Stream {
+			writeAPIError(c, apiErr)
+		}
+		trackRequest(c, startTime, apiErr.Status)
+		return
+	}
+
+	// 客户端中途断开时输出不完整，不保存
+	if store && c.Request.Context().Err() == nil {
+		saveResponse(response, append(conversation, outputToChatMessage(response.Output)))
+	}
+	trackRequest(c, startTime, http.StatusOK)
+}
+
+// finishResponse 根据 limiter 的结果设置响应状态和用量
+func finishResponse(response *ResponsesResponse, limiter *outputLimiter, inputTokens, outputTokens int) {
+	response.Status = "completed"
+	if limiter.FinishReason() == "length" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &ResponsesIncompleteDetails{Reason: "max_output_tokens"}
+	}
+	response.Usage = &ResponsesUsage{
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		TotalTokens:  inputTokens + outputTokens,
+	}
+}
+
+// writeResponse 读取上游出错时不写入响应，返回错误由调用方输出
+func writeResponse(c *gin.Context, stream EventStream, response *ResponsesResponse, tools *toolSettings, limiter *outputLimiter, inputTokens int) error {
+	content, err := aggregateStreamContent(stream, limiter)
+	if err != nil {
+		return err
+	}
+	finishResponse(response, limiter, inputTokens, estimateTokens(content))
+
+	text := content
+	var calls []ToolCall
+	if tools.enabled() {
+		text, calls = parseToolCalls(content, tools)
+	}
+	if text != "" || len(calls) == 0 {
+		response.Output = append(response.Output, ResponsesOutputItem{
+			Type:    "message",
+			ID:      newResponseID("msg_"),
+			Status:  response.Status,
+			Content: []ResponsesOutputText{{Type: "output_text", Text: text, Annotations: []interface{}{}}},
+		})
+	}
+	for _, call := range calls {
+		response.Output = append(response.Output, ResponsesOutputItem{
+			Type:      "function_call",
+			ID:        newResponseID("fc_"),
+			Status:    "completed",
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+	return nil
+}
+
+// streamResponse 读取上游出错时与 OpenAI 一致发送 response.failed 事件并结束响应，返回该错误
+func streamResponse(c *gin.Context, stream EventStream, response *ResponsesResponse, tools *toolSettings, limiter *outputLimiter, inputTokens int) error {
+	// 设置流式响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	var streamErr error
+	c.Stream(func(w io.Writer) bool {
+		sequence := 0
+		sendEvent := func(event string, data gin.H) {
+			data["type"] = event
+			data["sequence_number"] = sequence
+			sequence++
+			jsonData, _ := json.Marshal(data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, string(jsonData))
+			w.(http.Flusher).Flush()
+		}
+
+		sendEvent("response.created", gin.H{"response": response})
+		sendEvent("response.in_progress", gin.H{"response": response})
+
+		// 当前打开的输出项，nil 表示没有
+		var current *ResponsesOutputItem
+		var text strings.Builder
+		closeItem := func() {
+			if current == nil {
+				return
+			}
+			index := len(response.Output)
+			if current.Type == "message" {
+				part := ResponsesOutputText{Type: "output_text", Text: text.String(), Annotations: []interface{}{}}
+				sendEvent("response.output_text.done", gin.H{"item_id": current.ID, "output_index": index, "content_index": 0, "text": part.Text})
+				sendEvent("response.content_part.done", gin.H{"item_id": current.ID, "output_index": index, "content_index": 0, "part": part})
+				current.Content = []ResponsesOutputText{part}
+				current.Status = "completed"
+				if limiter.FinishReason() == "length" {
+					current.Status = "incomplete"
+				}
+			} else {
+				sendEvent("response.function_call_arguments.done", gin.H{"item_id": current.ID, "output_index": index, "arguments": current.Arguments})
+				current.Status = "completed"
+			}
+			sendEvent("response.output_item.done", gin.H{"output_index": index, "item": current})
+			response.Output = append(response.Output, *current)
+			current = nil
+		}
+		openItem := func(item ResponsesOutputItem) {
+			closeItem()
+			current = &item
+			sendEvent("response.output_item.added", gin.H{"output_index": len(response.Output), "item": current})
+			if item.Type == "message" {
+				text.Reset()
+				sendEvent("response.content_part.added", gin.H{
+					"item_id":       item.ID,
+					"output_index":  len(response.Output),
+					"content_index": 0,
+					"part":          ResponsesOutputText{Type: "output_text", Text: "", Annotations: []interface{}{}},
+				})
+			}
+		}
+		sendText := func(delta string) {
+			if current == nil || current.Type != "message" {
+				openItem(ResponsesOutputItem{Type: "message", ID: newResponseID("msg_"), Status: "in_progress"})
+			}
+			text.WriteString(delta)
+			sendEvent("response.output_text.delta", gin.H{"item_id": current.ID, "output_index": len(response.Output), "content_index": 0, "delta": delta})
+		}
+
+		var parser *toolCallParser
+		if tools.enabled() {
+			parser = newToolCallParser(tools)
+		}
+		sendEvents := func(events []toolEvent) {
+			for _, ev := range events {
+				switch ev.Kind {
+				case toolEventText:
+					sendText(ev.Text)
+				case toolEventStart:
+					openItem(ResponsesOutputItem{Type: "function_call", ID: newResponseID("fc_"), Status: "in_progress", CallID: ev.ID, Name: ev.Name})
+				case toolEventArgs:
+					current.Arguments += ev.Text
+					sendEvent("response.function_call_arguments.delta", gin.H{"item_id": current.ID, "output_index": len(response.Output), "delta": ev.Text})
+				}
+			}
+		}
+
+		var output tokenCounter
+		send := func(content string) {
+			if content == "" {
+				return
+			}
+			output.Add(content)
+			if parser != nil {
+				sendEvents(parser.Feed(content))
+			} else {
+				sendText(content)
+			}
+		}
+		streamErr = forEachStreamChunk(stream, func(content string) bool {
+			out, done := limiter.Feed(content)
+			send(out)
+			return !done
+		})
+		if streamErr != nil {
+			apiErr := upstreamAPIError(streamErr)
+			response.Status = "failed"
+			response.Error = gin.H{"code": nullableString(apiErr.Code), "message": apiErr.Message}
+			sendEvent("response.failed", gin.H{"response": response})
+			return false
+		}
+		send(limiter.Flush())
+		if parser != nil {
+			sendEvents(parser.Flush())
+		}
+		if current == nil && len(response.Output) == 0 {
+			openItem(ResponsesOutputItem{Type: "message", ID: newResponseID("msg_"), Status: "in_progress"})
+		}
+		closeItem()
+
+		finishResponse(response, limiter, inputTokens, output.Count())
+		if response.Status == "incomplete" {
+			sendEvent("response.incomplete", gin.H{"response": response})
+		} else {
+			sendEvent("response.completed", gin.H{"response": response})
+		}
+		return false
+	})
+	return streamErr
+}
+
+func getResponse(c *gin.Context) {
+	stored, ok := loadResponse(c.Param("id"))
+	if !ok {
+		writeAPIError(c, errNotFound("", "", fmt.Sprintf("Response with id '%s' not found.", c.Param("id"))))
+		return
+	}
+	c.JSON(http.StatusOK, stored.Response)
+}
+
+func deleteResponse(c *gin.Context) {
+	id := c.Param("id")
+	responseMutex.Lock()
+	_, ok := responseStore[id]
+	if ok {
+		delete(responseStore, id)
+		for i, storedID := range responseOrder {
+			if storedID == id {
+				responseOrder = append(responseOrder[:i], responseOrder[i+1:]...)
+				break
+			}
+		}
+	}
+	responseMutex.Unlock()
+
+	if !ok {
+		writeAPIError(c, errNotFound("", "", fmt.Sprintf("Response with id '%s' not found.", id)))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "response.deleted", "deleted": true})
+}
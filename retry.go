@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retryCounterKey 请求 context 中保存上游重试次数计数器的键
+type retryCounterKey struct{}
+
+// trackUpstreamRetries 为每个请求的 context 附加重试计数器，trackRequest 从中读取重试次数
+func trackUpstreamRetries(c *gin.Context) {
+	ctx := context.WithValue(c.Request.Context(), retryCounterKey{}, new(int64))
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// upstreamRetries 返回本次请求中上游请求的重试次数
+func upstreamRetries(ctx context.Context) int {
+	if counter, ok := ctx.Value(retryCounterKey{}).(*int64); ok {
+		return int(atomic.LoadInt64(counter))
+	}
+	return 0
+}
+
+// parseRetryAfter 解析 Retry-After 响应头，支持秒数和 HTTP 日期两种格式，无法解析时返回 0
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryableError 判断错误是否值得重试：连接错误、429 和 5xx。客户端断开、账号池没有可用账号，
+// 以及配置错误、请求构造失败等与网络无关的错误不重试
+func retryableError(ctx context.Context, err error) bool {
+	var accountsErr *AccountsUnavailableError
+	if ctx.Err() != nil || errors.As(err, &accountsErr) {
+		return false
+	}
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// retryDelay 第 attempt 次重试前的等待时间：指数退避加随机抖动（在 [d/2, d) 之间），
+// 上游返回了 Retry-After 时以它为准
+func retryDelay(attempt int, err error) time.Duration {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+
+	base := time.Duration(config.UpstreamRetryBaseDelay) * time.Millisecond
+	maxDelay := time.Duration(config.UpstreamRetryMaxDelay) * time.Millisecond
+	d := base << uint(attempt-1)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// countRetry 本次请求的上游重试次数加一
+func countRetry(ctx context.Context) {
+	if counter, ok := ctx.Value(retryCounterKey{}).(*int64); ok {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+// streamWithRetry 按模型的负载均衡策略依次尝试上游端点，连接错误、429 和 5xx 时立即切换到下一个端点；
+// 所有端点都失败后整轮退避重试，最多 UPSTREAM_MAX_RETRIES 轮。重试和切换只发生在拿到上游响应之前，
+// 此时还没有向客户端写入任何内容。每个端点 + 模型有独立的熔断器，熔断打开的端点会被跳过，
+// 全部熔断时直接返回 CircuitOpenError
+func streamWithRetry(ctx context.Context, p Provider, model string, req TalkAIRequest) (EventStream, error) {
+	group := upstreamGroupFor(p.Name())
+	candidates := []*upstream{nil}
+	if group != nil {
+		candidates = group.Candidates(balanceStrategyFor(model))
+	}
+
+	attempts := 0
+	for round := 1; ; round++ {
+		var lastErr, openErr error
+		for _, u := range candidates {
+			name := upstreamName(p, u)
+			breaker := breakerFor(name, model)
+			probe, err := breaker.Allow()
+			if err != nil {
+				openErr = err
+				continue
+			}
+			if attempts > 0 {
+				countRetry(ctx)
+			}
+			attempts++
+
+			stream, err := openUpstream(ctx, p, group, u, req)
+			breaker.Record(ctx, probe, err)
+			if err == nil {
+				return stream, nil
+			}
+			if !retryableError(ctx, err) {
+				return nil, err
+			}
+			lastErr = err
+			if len(candidates) > 1 {
+				log.Printf("上游 %s 请求失败，切换到下一个上游: %v", name, err)
+			}
+		}
+
+		if lastErr == nil {
+			return nil, openErr
+		}
+		if round > config.UpstreamMaxRetries {
+			return nil, lastErr
+		}
+		delay := retryDelay(round, lastErr)
+		if delay > time.Duration(config.UpstreamRetryMaxDelay)*time.Millisecond {
+			log.Printf("上游要求 %v 后重试，超过 UPSTREAM_RETRY_MAX_DELAY，不再重试: %v", delay, lastErr)
+			return nil, lastErr
+		}
+		log.Printf("上游请求失败，%v 后进行第 %d 次重试: %v", delay.Round(time.Millisecond), round, lastErr)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
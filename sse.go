@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// sseEvent 一个 Server-Sent Events 事件。Event 未指定时为 "message"，
+// 多行 data 按规范用 "\n" 连接，字段值只去掉冒号后的一个空格，其余空白原样保留
+type sseEvent struct {
+	Event string
+	Data  string
+	ID    string
+	Retry int
+}
+
+// sseDecoder 按 WHATWG 规范解码 text/event-stream：支持 CRLF、LF 和单独的 CR 换行，
+// 忽略注释行，处理 event/id/retry 字段，行长度没有限制，读取错误原样返回
+type sseDecoder struct {
+	r       *bufio.Reader
+	line    []byte
+	skipLF  bool
+	started bool
+	lastID  string
+	retry   int
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func newSSEDecoder(r io.Reader) *sseDecoder {
+	return &sseDecoder{r: bufio.NewReader(r), retry: -1}
+}
+
+// readLine 读取一行，不含换行符。最后一行没有换行符时也会返回，之后返回 io.EOF
+func (d *sseDecoder) readLine() (string, error) {
+	if !d.started {
+		d.started = true
+		if prefix, err := d.r.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+			d.r.Discard(len(utf8BOM))
+		}
+	}
+
+	d.line = d.line[:0]
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(d.line) > 0 {
+				return string(d.line), nil
+			}
+			return "", err
+		}
+		// CRLF 中的 LF 属于上一行的换行符
+		if d.skipLF {
+			d.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\n':
+			return string(d.line), nil
+		case '\r':
+			d.skipLF = true
+			return string(d.line), nil
+		}
+		d.line = append(d.line, b)
+	}
+}
+
+// Next 返回下一个事件，流结束时返回 io.EOF。
+// 规范要求丢弃结尾没有空行的事件，但上游可能在最后一个事件后直接关闭连接，这里仍然返回它
+func (d *sseDecoder) Next() (sseEvent, error) {
+	var data strings.Builder
+	hasData := false
+	eventType := ""
+
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if err == io.EOF && hasData {
+				return d.event(eventType, data.String()), nil
+			}
+			return sseEvent{}, err
+		}
+
+		// 空行：分发事件；没有 data 字段的事件直接丢弃
+		if line == "" {
+			if hasData {
+				return d.event(eventType, data.String()), nil
+			}
+			eventType = ""
+			continue
+		}
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "event":
+			eventType = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && !strings.HasPrefix(value, "+") {
+				d.retry = n
+			}
+		}
+	}
+}
+
+func (d *sseDecoder) event(eventType, data string) sseEvent {
+	if eventType == "" {
+		eventType = "message"
+	}
+	return sseEvent{Event: eventType, Data: data, ID: d.lastID, Retry: d.retry}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeAll 读取全部事件，直到 io.EOF 或出错
+func decodeAll(t *testing.T, input string) []sseEvent {
+	t.Helper()
+	d := newSSEDecoder(strings.NewReader(input))
+	var events []sseEvent
+	for {
+		ev, err := d.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestSSEDecoder(t *testing.T) {
+	long := strings.Repeat("x", 70<<10)
+
+	tests := []struct {
+		name  string
+		input string
+		want  []sseEvent
+	}{
+		{
+			name:  "LF",
+			input: "data: a\n\ndata: b\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}, {Event: "message", Data: "b", Retry: -1}},
+		},
+		{
+			name:  "CRLF",
+			input: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}, {Event: "message", Data: "b", Retry: -1}},
+		},
+		{
+			name:  "lone CR",
+			input: "data: a\r\rdata: b\r\r",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}, {Event: "message", Data: "b", Retry: -1}},
+		},
+		{
+			name:  "mixed line endings",
+			input: "data: a\rdata: b\r\ndata: c\n\r\n",
+			want:  []sseEvent{{Event: "message", Data: "a\nb\nc", Retry: -1}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: first\ndata: second\ndata:\ndata: fourth\n\n",
+			want:  []sseEvent{{Event: "message", Data: "first\nsecond\n\nfourth", Retry: -1}},
+		},
+		{
+			name:  "event id and retry",
+			input: "event: update\nid: 42\nretry: 3000\ndata: x\n\ndata: y\n\n",
+			want: []sseEvent{
+				{Event: "update", Data: "x", ID: "42", Retry: 3000},
+				// id 和 retry 在之后的事件中保持，event 只作用于当前事件
+				{Event: "message", Data: "y", ID: "42", Retry: 3000},
+			},
+		},
+		{
+			name:  "invalid retry and id with NUL ignored",
+			input: "id: 1\ndata: a\n\nretry: +5\nretry: abc\nid: 2\x003\ndata: b\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", ID: "1", Retry: -1}, {Event: "message", Data: "b", ID: "1", Retry: -1}},
+		},
+		{
+			name:  "empty id resets last id",
+			input: "id: 1\ndata: a\n\nid\ndata: b\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", ID: "1", Retry: -1}, {Event: "message", Data: "b", Retry: -1}},
+		},
+		{
+			name:  "BOM",
+			input: "\xEF\xBB\xBFdata: a\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "BOM only stripped at start",
+			input: "data: a\n\n\xEF\xBB\xBFdata: b\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "comment lines",
+			input: ": keep-alive\ndata: a\n:another\n\n: only a comment\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "line over 64KB",
+			input: "data: " + long + "\n\n",
+			want:  []sseEvent{{Event: "message", Data: long, Retry: -1}},
+		},
+		{
+			name:  "leading spaces preserved",
+			input: "data:   indented\ndata:no space\ndata:  \n\n",
+			want:  []sseEvent{{Event: "message", Data: "  indented\nno space\n ", Retry: -1}},
+		},
+		{
+			name:  "field without colon",
+			input: "data\n\n",
+			want:  []sseEvent{{Event: "message", Data: "", Retry: -1}},
+		},
+		{
+			name:  "unknown fields ignored",
+			input: "foo: bar\ndata: a\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "event without data dropped",
+			input: "event: ping\n\ndata: a\n\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "missing trailing blank line",
+			input: "data: a\n\nevent: last\ndata: b",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}, {Event: "last", Data: "b", Retry: -1}},
+		},
+		{
+			name:  "missing trailing newline after data line",
+			input: "data: a\n",
+			want:  []sseEvent{{Event: "message", Data: "a", Retry: -1}},
+		},
+		{
+			name:  "empty input",
+			input: "",
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeAll(t, tt.input)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decode(%q) = %+v, want %+v", truncateForLog(tt.input), got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSSEDecoderReadError 读取错误原样返回
+func TestSSEDecoderReadError(t *testing.T) {
+	d := newSSEDecoder(io.MultiReader(strings.NewReader("data: a\n\ndata: b\n"), errReader{io.ErrUnexpectedEOF}))
+	if ev, err := d.Next(); err != nil || ev.Data != "a" {
+		t.Fatalf("first Next() = %+v, %v", ev, err)
+	}
+	if _, err := d.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("second Next() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func truncateForLog(s string) string {
+	if len(s) > 80 {
+		return s[:80] + "..."
+	}
+	return s
+}
+
+// encodeSSE 按规范编码一个事件，data 中的换行拆成多个 data 字段
+func encodeSSE(event, data string) string {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(normalizeNewlines(data), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
+
+func FuzzSSEDecoder(f *testing.F) {
+	f.Add("data: a\n\n", "update")
+	f.Add("data: a\r\ndata: b\r\n\r\n", "")
+	f.Add("\xEF\xBB\xBFdata:  x\rid: 1\rretry: 10\r\r", "  spaced")
+	f.Add(": comment\nevent\ndata\n", "e\rv")
+	f.Add("data: "+strings.Repeat("y", 70<<10), "\xEF\xBB\xBF")
+
+	f.Fuzz(func(t *testing.T, raw, event string) {
+		// 任意输入都不能 panic，并且最终返回错误结束
+		d := newSSEDecoder(strings.NewReader(raw))
+		for i := 0; ; i++ {
+			if _, err := d.Next(); err != nil {
+				break
+			}
+			if i > len(raw) {
+				t.Fatalf("decoder returned more events than input bytes for %q", truncateForLog(raw))
+			}
+		}
+
+		// 规范编码的事件解码后与原内容一致
+		event = strings.NewReplacer("\r", "", "\n", "").Replace(event)
+		input := encodeSSE(event, raw) + encodeSSE("", "tail")
+		got := decodeAll(t, input)
+		wantEvent := event
+		if wantEvent == "" {
+			wantEvent = "message"
+		}
+		want := []sseEvent{
+			{Event: wantEvent, Data: normalizeNewlines(raw), Retry: -1},
+			{Event: "message", Data: "tail", Retry: -1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round trip of event %q data %q = %+v, want %+v", event, truncateForLog(raw), got, want)
+		}
+	})
+}
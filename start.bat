@@ -407,7 +407,7 @@ if %errorlevel% equ 0 (
         
         if "%DAEMON_MODE%"=="true" (
             echo [以后台模式启动服务...]
-            start /B go run main.go > "%LOG_FILE%" 2>&1
+            start /B go run . > "%LOG_FILE%" 2>&1
             echo !PID_FILE! > "%PID_FILE%"
             echo [服务已启动]
             echo [日志文件: %LOG_FILE%]
@@ -416,7 +416,7 @@ if %errorlevel% equ 0 (
         ) else (
             echo [启动 TalkAI OpenAI API 适配器...]
             echo.
-            go run main.go
+            go run .
         )
         exit /b 0
         
@@ -386,7 +386,7 @@ start_service() {
     
     if [[ "$DAEMON_MODE" == true ]]; then
         echo -e "${YELLOW}以后台模式启动服务...${NC}"
-        nohup go run main.go > "$LOG_FILE" 2>&1 &
+        nohup go run . > "$LOG_FILE" 2>&1 &
         echo $! > "$PID_FILE"
         echo -e "${GREEN}服务已启动 (PID: $!)${NC}"
         echo -e "${CYAN}日志文件: $LOG_FILE${NC}"
@@ -402,7 +402,7 @@ start_service() {
         echo -e "${BLUE}  API 文档: http://localhost:$PORT/docs${NC}"
         echo -e "${BLUE}  监控面板: http://localhost:$PORT/dashboard${NC}"
         echo ""
-        exec go run main.go
+        exec go run .
     fi
 }
 
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templatesFile 提示词模板文件，通过管理接口修改的模板会写回该文件
+const templatesFile = "templates.json"
+
+// PromptTemplateConfig templates.json 中的模板定义，Variables 为变量的默认值。
+// Version 由代理维护，内容或默认值变化时加 1
+type PromptTemplateConfig struct {
+	Content     string            `json:"content"`
+	Variables   map[string]string `json:"variables,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	UpdatedAt   *time.Time        `json:"updated_at,omitempty"`
+}
+
+// PromptTemplateRef 请求中的 prompt_template 扩展字段，Name 为空时使用模型名后缀指定的模板
+type PromptTemplateRef struct {
+	Name      string                 `json:"name"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// PromptTemplateStatus 管理接口返回的模板信息
+type PromptTemplateStatus struct {
+	Name string `json:"name"`
+	PromptTemplateConfig
+	Placeholders []string `json:"placeholders"`
+}
+
+var (
+	promptTemplates = make(map[string]PromptTemplateConfig)
+	templatesMutex  sync.Mutex
+)
+
+var (
+	templateNamePattern     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// promptTemplateKey 记录本次请求使用的模板，trackRequest 从中读取并显示在 Dashboard 中
+const promptTemplateKey = "prompt_template"
+
+// validatePromptTemplate 校验模板名称和内容
+func validatePromptTemplate(name string, tmpl PromptTemplateConfig) error {
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name '%s': use letters, digits, '_', '.' and '-'", name)
+	}
+	if strings.TrimSpace(tmpl.Content) == "" {
+		return fmt.Errorf("template '%s': content is required", name)
+	}
+	return nil
+}
+
+// templatePlaceholders 返回模板内容中出现的变量名（去重，按出现顺序）
+func templatePlaceholders(content string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, m := range templateVariablePattern.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// loadPromptTemplates 从 templates.json（可选）加载提示词模板，格式为 {"名称": 模板定义}
+func loadPromptTemplates() {
+	data, err := os.ReadFile(templatesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取 %s 出错: %v", templatesFile, err)
+		}
+		return
+	}
+
+	var fileTemplates map[string]PromptTemplateConfig
+	if err := json.Unmarshal(data, &fileTemplates); err != nil {
+		log.Printf("解析 %s 出错: %v", templatesFile, err)
+		return
+	}
+
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+	for name, tmpl := range fileTemplates {
+		if err := validatePromptTemplate(name, tmpl); err != nil {
+			log.Printf("提示词模板配置无效: %v", err)
+			continue
+		}
+		if tmpl.Version <= 0 {
+			tmpl.Version = 1
+		}
+		promptTemplates[name] = tmpl
+	}
+}
+
+// savePromptTemplatesLocked 将模板写回 templates.json，先写临时文件再替换，调用方需持有 templatesMutex
+func savePromptTemplatesLocked() error {
+	data, err := json.MarshalIndent(promptTemplates, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := templatesFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, templatesFile)
+}
+
+// templateValue 将请求中的变量值转换为文本，字符串原样使用，其他类型使用 JSON 表示
+func templateValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// renderPromptTemplate 展开模板中的 {{变量}}，请求中的值优先于模板的默认值，缺少变量时返回错误
+func renderPromptTemplate(name string, tmpl PromptTemplateConfig, variables map[string]interface{}) (string, error) {
+	missing := ""
+	rendered := templateVariablePattern.ReplaceAllStringFunc(tmpl.Content, func(match string) string {
+		key := templateVariablePattern.FindStringSubmatch(match)[1]
+		if value, ok := variables[key]; ok {
+			return templateValue(value)
+		}
+		if value, ok := tmpl.Variables[key]; ok {
+			return value
+		}
+		if missing == "" {
+			missing = key
+		}
+		return match
+	})
+	if missing != "" {
+		return "", errInvalidRequest("prompt_template.variables", "missing_template_variable",
+			fmt.Sprintf("Prompt template '%s' requires variable '%s'.", name, missing))
+	}
+	return rendered, nil
+}
+
+// resolvePromptTemplate 解析请求引用的提示词模板：prompt_template.name 优先，其次是模型名的 @ 后缀
+// （如 claude-sonnet-4-20250514@support-bot）。返回去掉后缀的模型名和展开后的提示词，
+// 没有引用模板时提示词为空。使用的模板和版本通过 X-Prompt-Template 响应头返回，并记录到 Dashboard
+func resolvePromptTemplate(c *gin.Context, model string, ref *PromptTemplateRef) (string, string, error) {
+	name, param := "", "model"
+	if i := strings.LastIndex(model, "@"); i >= 0 {
+		model, name = model[:i], model[i+1:]
+	}
+	var variables map[string]interface{}
+	if ref != nil {
+		if ref.Name != "" {
+			name, param = ref.Name, "prompt_template.name"
+		}
+		variables = ref.Variables
+	}
+	if name == "" {
+		if len(variables) > 0 {
+			return "", "", errInvalidRequest("prompt_template.name", "", "prompt_template.name: a template name is required")
+		}
+		return model, "", nil
+	}
+
+	templatesMutex.Lock()
+	tmpl, ok := promptTemplates[name]
+	templatesMutex.Unlock()
+	if !ok {
+		return "", "", errNotFound(param, "template_not_found", fmt.Sprintf("Prompt template '%s' not found.", name))
+	}
+	prompt, err := renderPromptTemplate(name, tmpl, variables)
+	if err != nil {
+		return "", "", err
+	}
+
+	c.Set(promptTemplateKey, fmt.Sprintf("%s v%d", name, tmpl.Version))
+	c.Header("X-Prompt-Template", name)
+	c.Header("X-Prompt-Template-Version", strconv.Itoa(tmpl.Version))
+	return model, prompt, nil
+}
+
+// prependSystemPrompt 将模板展开后的提示词作为第一条系统消息，排在请求自带的系统消息之前
+func prependSystemPrompt(messages []ChatMessage, prompt string) []ChatMessage {
+	if prompt == "" {
+		return messages
+	}
+	return append([]ChatMessage{{Role: "system", Content: textContent(prompt)}}, messages...)
+}
+
+// templateStatus 返回模板的管理接口表示
+func templateStatus(name string, tmpl PromptTemplateConfig) PromptTemplateStatus {
+	return PromptTemplateStatus{Name: name, PromptTemplateConfig: tmpl, Placeholders: templatePlaceholders(tmpl.Content)}
+}
+
+// getPromptTemplatesData 返回所有模板，按名称排序
+func getPromptTemplatesData() []PromptTemplateStatus {
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+
+	result := make([]PromptTemplateStatus, 0, len(promptTemplates))
+	for name, tmpl := range promptTemplates {
+		result = append(result, templateStatus(name, tmpl))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// handleAdminListTemplates 列出所有提示词模板
+func handleAdminListTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"templates": getPromptTemplatesData()})
+}
+
+// handleAdminGetTemplate 查看单个提示词模板
+func handleAdminGetTemplate(c *gin.Context) {
+	name := c.Param("name")
+	templatesMutex.Lock()
+	tmpl, ok := promptTemplates[name]
+	templatesMutex.Unlock()
+	if !ok {
+		writeAPIError(c, errNotFound("", "template_not_found", fmt.Sprintf("Prompt template '%s' not found.", name)))
+		return
+	}
+	c.JSON(http.StatusOK, templateStatus(name, tmpl))
+}
+
+// handleAdminPutTemplate 创建或替换提示词模板。内容或变量默认值变化时版本号加 1，
+// 修改会写回 templates.json
+func handleAdminPutTemplate(c *gin.Context) {
+	var tmpl PromptTemplateConfig
+	if err := c.ShouldBindJSON(&tmpl); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", "Invalid request body: "+err.Error()))
+		return
+	}
+	name := c.Param("name")
+	if err := validatePromptTemplate(name, tmpl); err != nil {
+		writeAPIError(c, errInvalidRequest("", "", err.Error()))
+		return
+	}
+
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+	previous, exists := promptTemplates[name]
+	status := http.StatusCreated
+	tmpl.Version = 1
+	if exists {
+		status = http.StatusOK
+		tmpl.Version = previous.Version
+		if previous.Content != tmpl.Content || !sameTemplateVariables(previous.Variables, tmpl.Variables) {
+			tmpl.Version++
+		}
+	}
+	now := time.Now()
+	tmpl.UpdatedAt = &now
+	if exists && tmpl.Version == previous.Version {
+		tmpl.UpdatedAt = previous.UpdatedAt
+	}
+	promptTemplates[name] = tmpl
+	if err := savePromptTemplatesLocked(); err != nil {
+		// 保存失败时恢复修改前的模板，内存中的模板与文件保持一致
+		if exists {
+			promptTemplates[name] = previous
+		} else {
+			delete(promptTemplates, name)
+		}
+		log.Printf("保存 %s 出错: %v", templatesFile, err)
+		writeAPIError(c, errInternal(fmt.Sprintf("Failed to save prompt template '%s': %v", name, err)))
+		return
+	}
+	log.Printf("已更新提示词模板 %s（版本 %d）", name, tmpl.Version)
+	c.JSON(status, templateStatus(name, tmpl))
+}
+
+// sameTemplateVariables 判断两组变量默认值是否相同
+func sameTemplateVariables(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// handleAdminDeleteTemplate 删除提示词模板
+func handleAdminDeleteTemplate(c *gin.Context) {
+	name := c.Param("name")
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+	previous, ok := promptTemplates[name]
+	if !ok {
+		writeAPIError(c, errNotFound("", "template_not_found", fmt.Sprintf("Prompt template '%s' not found.", name)))
+		return
+	}
+	delete(promptTemplates, name)
+	if err := savePromptTemplatesLocked(); err != nil {
+		promptTemplates[name] = previous
+		log.Printf("保存 %s 出错: %v", templatesFile, err)
+		writeAPIError(c, errInternal(fmt.Sprintf("Failed to delete prompt template '%s': %v", name, err)))
+		return
+	}
+	log.Printf("已删除提示词模板 %s", name)
+	c.JSON(http.StatusOK, gin.H{"name": name, "deleted": true})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenCounter 增量估算 token 数量，分多次 Add 与一次性估算整段文本结果一致。
+// 英文等拉丁文字按约 4 个字符一个 token 计算，中日韩字符按每字一个 token，
+// 数字约每 3 位一个 token，标点和其他符号单独计数
+type tokenCounter struct {
+	tokens  int
+	wordLen int
+}
+
+// Add 累加一段文本
+func (t *tokenCounter) Add(text string) {
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			t.flushWord()
+			t.tokens++
+		case unicode.IsLetter(r):
+			t.wordLen++
+		case unicode.IsDigit(r):
+			t.wordLen += 4
+			if t.wordLen >= 12 {
+				t.flushWord()
+			}
+		case unicode.IsSpace(r):
+			t.flushWord()
+		default:
+			t.flushWord()
+			t.tokens++
+		}
+	}
+}
+
+// Count 当前累计的 token 数量
+func (t tokenCounter) Count() int {
+	return t.tokens + (t.wordLen+3)/4
+}
+
+func (t *tokenCounter) flushWord() {
+	t.tokens += (t.wordLen + 3) / 4
+	t.wordLen = 0
+}
+
+// estimateTokens 本地估算文本的 token 数量
+func estimateTokens(text string) int {
+	var counter tokenCounter
+	counter.Add(text)
+	return counter.Count()
+}
+
+// messageTokenOverhead 每条消息的角色标记等额外开销
+const messageTokenOverhead = 4
+
+// estimatePromptTokens 估算发送给上游的消息历史的 token 数量
+func estimatePromptTokens(history []TalkAIMessage) int {
+	total := 0
+	for _, msg := range history {
+		total += estimateTokens(msg.Content) + messageTokenOverhead
+	}
+	return total
+}
+
+// usageMap 生成 OpenAI 格式的 usage 字段
+func usageMap(promptTokens, completionTokens int) map[string]int {
+	return map[string]int{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+}
+
+// isCJK 判断是否为中日韩文字
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+// truncateToTokens 在 counter 已有计数的基础上，截取 text 中使总数不超过 maxTokens 的最长前缀
+func truncateToTokens(counter tokenCounter, text string, maxTokens int) string {
+	fits := func(prefix string) bool {
+		c := counter
+		c.Add(prefix)
+		return c.Count() <= maxTokens
+	}
+	if fits(text) {
+		return text
+	}
+
+	// 在字符边界上二分查找
+	lo, hi := 0, len(text)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		for mid > lo && mid < len(text) && !utf8.RuneStart(text[mid]) {
+			mid--
+		}
+		if mid <= lo {
+			break
+		}
+		if fits(text[:mid]) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return text[:lo]
+}
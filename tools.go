@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// FunctionDefinition 工具（函数）定义
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// Tool OpenAI 工具定义
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionCall 函数调用（名称与 JSON 字符串形式的参数）
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCall 助手消息中的工具调用
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+const (
+	toolCallOpenTag  = "<tool_call"
+	toolCallCloseTag = "</tool_call>"
+)
+
+var toolCallNameAttr = regexp.MustCompile(`name\s*=\s*"([^"]*)"`)
+
+// toolSettings 一次请求中工具调用模拟的设置
+type toolSettings struct {
+	Tools    []Tool
+	Choice   string // none / auto / required / function
+	Forced   string // Choice 为 function 时指定的工具名
+	Parallel bool
+	Legacy   bool // 使用旧版 functions / function_call 字段
+}
+
+// resolveToolSettings 从请求中解析工具设置，未提供工具时返回 nil
+func resolveToolSettings(req *ChatCompletionRequest) (*toolSettings, error) {
+	settings := &toolSettings{Choice: "auto", Parallel: true}
+	rawChoice := req.ToolChoice
+
+	if len(req.Tools) > 0 {
+		for i, tool := range req.Tools {
+			if tool.Type != "" && tool.Type != "function" {
+				return nil, fmt.Errorf("tools[%d].type: unsupported tool type '%s'", i, tool.Type)
+			}
+			if tool.Function.Name == "" {
+				return nil, fmt.Errorf("tools[%d].function.name is required", i)
+			}
+			tool.Type = "function"
+			settings.Tools = append(settings.Tools, tool)
+		}
+	} else if len(req.Functions) > 0 {
+		for i, fn := range req.Functions {
+			if fn.Name == "" {
+				return nil, fmt.Errorf("functions[%d].name is required", i)
+			}
+			settings.Tools = append(settings.Tools, Tool{Type: "function", Function: fn})
+		}
+		settings.Legacy = true
+		settings.Parallel = false
+		rawChoice = req.FunctionCall
+	} else {
+		return nil, nil
+	}
+
+	if req.ParallelToolCalls != nil {
+		settings.Parallel = *req.ParallelToolCalls && !settings.Legacy
+	}
+
+	rawChoice = bytes.TrimSpace(rawChoice)
+	if len(rawChoice) == 0 || bytes.Equal(rawChoice, []byte("null")) {
+		return settings, nil
+	}
+
+	var choice string
+	if err := json.Unmarshal(rawChoice, &choice); err == nil {
+		switch choice {
+		case "none", "auto", "required":
+			settings.Choice = choice
+			return settings, nil
+		}
+		return nil, fmt.Errorf("tool_choice: invalid value '%s'", choice)
+	}
+
+	var named struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(rawChoice, &named); err != nil {
+		return nil, fmt.Errorf("tool_choice: %v", err)
+	}
+	name := named.Function.Name
+	if name == "" {
+		name = named.Name
+	}
+	if name == "" {
+		return nil, fmt.Errorf("tool_choice: function name is required")
+	}
+	found := false
+	for _, tool := range settings.Tools {
+		if tool.Function.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("tool_choice: unknown function '%s'", name)
+	}
+	settings.Choice = "function"
+	settings.Forced = name
+	return settings, nil
+}
+
+// enabled 是否需要向上游注入工具说明并解析工具调用
+func (s *toolSettings) enabled() bool {
+	return s != nil && s.Choice != "none"
+}
+
+// buildToolPrompt 构造注入到提示词中的工具说明
+func buildToolPrompt(s *toolSettings) string {
+	if !s.enabled() {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("You have access to the following tools. To call a tool, reply with a block in exactly this format:\n")
+	b.WriteString("<tool_call name=\"TOOL_NAME\">\n{\"argument\": \"value\"}\n</tool_call>\n")
+	b.WriteString("The body of the block must be a single JSON object matching the tool's parameters schema. ")
+	b.WriteString("After emitting tool calls, stop your reply and wait: the results will be sent back to you inside <tool_result> blocks. ")
+	b.WriteString("Never write <tool_result> blocks yourself. If no tool is needed, answer normally without any <tool_call> block.\n")
+
+	switch s.Choice {
+	case "required":
+		b.WriteString("You must call at least one tool in this reply.\n")
+	case "function":
+		fmt.Fprintf(&b, "You must call the tool \"%s\" in this reply.\n", s.Forced)
+	}
+	if !s.Parallel {
+		b.WriteString("Call at most one tool per reply.\n")
+	}
+
+	b.WriteString("\nAvailable tools:\n")
+	for _, tool := range s.Tools {
+		fmt.Fprintf(&b, "- name: %s\n", tool.Function.Name)
+		if tool.Function.Description != "" {
+			fmt.Fprintf(&b, "  description: %s\n", tool.Function.Description)
+		}
+		params := bytes.TrimSpace(tool.Function.Parameters)
+		if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+			params = []byte(`{"type":"object","properties":{}}`)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, params); err == nil {
+			params = compact.Bytes()
+		}
+		fmt.Fprintf(&b, "  parameters: %s\n", params)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// renderToolCall 将历史中的工具调用还原为模型可理解的文本格式
+func renderToolCall(call FunctionCall) string {
+	args := strings.TrimSpace(call.Arguments)
+	if args == "" {
+		args = "{}"
+	}
+	return fmt.Sprintf("<tool_call name=\"%s\">\n%s\n%s", call.Name, args, toolCallCloseTag)
+}
+
+// renderToolResult 将工具执行结果转换为模型可理解的文本格式
+func renderToolResult(name, callID, content string) string {
+	attrs := ""
+	if name != "" {
+		attrs += fmt.Sprintf(" name=\"%s\"", name)
+	}
+	if callID != "" {
+		attrs += fmt.Sprintf(" tool_call_id=\"%s\"", callID)
+	}
+	return fmt.Sprintf("<tool_result%s>\n%s\n</tool_result>", attrs, content)
+}
+
+// newToolCallID 生成工具调用 ID
+func newToolCallID() string {
+	return "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// partialSuffixLen 返回 s 的后缀中可能是 marker 前缀的最长长度，用于跨分块匹配
+func partialSuffixLen(s, marker string) int {
+	max := len(marker) - 1
+	if max > len(s) {
+		max = len(s)
+	}
+	for n := max; n > 0; n-- {
+		if strings.HasPrefix(marker, s[len(s)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
+
+type toolEventKind int
+
+const (
+	toolEventText toolEventKind = iota
+	toolEventStart
+	toolEventArgs
+)
+
+// toolEvent 工具调用解析器输出的事件
+type toolEvent struct {
+	Kind  toolEventKind
+	Text  string // 文本内容或参数片段
+	Index int    // 工具调用序号
+	ID    string
+	Name  string
+}
+
+// toolCallParser 增量解析模型输出中的 <tool_call> 块
+type toolCallParser struct {
+	pending string
+	inCall  bool
+	name    string // 为空时表示块内为 {"name":...,"arguments":...} 格式
+	id      string
+	body    strings.Builder
+	wrote   bool
+	spaces  string
+	count   int
+	limit   int  // 最多解析的调用数量，0 表示不限
+	skip    bool // 超出数量限制的调用块直接丢弃
+	events  []toolEvent
+}
+
+func newToolCallParser(s *toolSettings) *toolCallParser {
+	p := &toolCallParser{}
+	if !s.Parallel {
+		p.limit = 1
+	}
+	return p
+}
+
+// Feed 输入一段模型输出，返回可以立即下发的事件
+func (p *toolCallParser) Feed(chunk string) []toolEvent {
+	p.pending += chunk
+	p.events = nil
+
+	for {
+		if !p.inCall {
+			idx := strings.Index(p.pending, toolCallOpenTag)
+			if idx < 0 {
+				keep := partialSuffixLen(p.pending, toolCallOpenTag)
+				p.emitText(p.pending[:len(p.pending)-keep])
+				p.pending = p.pending[len(p.pending)-keep:]
+				return p.events
+			}
+			end := strings.Index(p.pending[idx:], ">")
+			if end < 0 {
+				p.emitText(p.pending[:idx])
+				p.pending = p.pending[idx:]
+				return p.events
+			}
+			p.emitText(p.pending[:idx])
+			p.openCall(p.pending[idx : idx+end+1])
+			p.pending = p.pending[idx+end+1:]
+			continue
+		}
+
+		idx := strings.Index(p.pending, toolCallCloseTag)
+		if idx < 0 {
+			keep := partialSuffixLen(p.pending, toolCallCloseTag)
+			p.writeBody(p.pending[:len(p.pending)-keep])
+			p.pending = p.pending[len(p.pending)-keep:]
+			return p.events
+		}
+		p.writeBody(p.pending[:idx])
+		p.closeCall()
+		p.pending = p.pending[idx+len(toolCallCloseTag):]
+	}
+}
+
+// Flush 上游输出结束时调用，处理缓冲中剩余的内容
+func (p *toolCallParser) Flush() []toolEvent {
+	p.events = nil
+	if p.inCall {
+		// 输出被截断，没有闭合标签
+		p.writeBody(p.pending)
+		p.closeCall()
+	} else {
+		p.emitText(p.pending)
+	}
+	p.pending = ""
+	return p.events
+}
+
+// Count 已解析出的工具调用数量
+func (p *toolCallParser) Count() int {
+	return p.count
+}
+
+func (p *toolCallParser) emitText(text string) {
+	if text == "" {
+		return
+	}
+	// 工具调用之间的空白不作为正文输出
+	if p.count > 0 && strings.TrimSpace(text) == "" {
+		return
+	}
+	p.events = append(p.events, toolEvent{Kind: toolEventText, Text: text})
+}
+
+func (p *toolCallParser) openCall(tag string) {
+	p.inCall = true
+	p.id = newToolCallID()
+	p.name = ""
+	p.body.Reset()
+	p.wrote = false
+	p.spaces = ""
+	p.skip = p.limit > 0 && p.count >= p.limit
+	if p.skip {
+		return
+	}
+	if m := toolCallNameAttr.FindStringSubmatch(tag); m != nil {
+		p.name = m[1]
+	}
+	if p.name != "" {
+		p.events = append(p.events, toolEvent{Kind: toolEventStart, Index: p.count, ID: p.id, Name: p.name})
+	}
+}
+
+func (p *toolCallParser) writeBody(text string) {
+	if text == "" || p.skip {
+		return
+	}
+	if p.name == "" {
+		p.body.WriteString(text)
+		return
+	}
+
+	// 参数片段直接下发，首尾空白去掉
+	if !p.wrote {
+		text = strings.TrimLeft(text, " \t\r\n")
+		if text == "" {
+			return
+		}
+	}
+	trimmed := strings.TrimRight(text, " \t\r\n")
+	if trimmed == "" {
+		p.spaces += text
+		return
+	}
+	p.events = append(p.events, toolEvent{Kind: toolEventArgs, Index: p.count, Text: p.spaces + trimmed})
+	p.spaces = text[len(trimmed):]
+	p.wrote = true
+}
+
+func (p *toolCallParser) closeCall() {
+	p.inCall = false
+	if p.skip {
+		return
+	}
+	if p.name != "" {
+		if !p.wrote {
+			p.events = append(p.events, toolEvent{Kind: toolEventArgs, Index: p.count, Text: "{}"})
+		}
+		p.count++
+		return
+	}
+
+	var call struct {
+		Name       string          `json:"name"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	body := strings.TrimSpace(p.body.String())
+	if err := json.Unmarshal([]byte(body), &call); err != nil || call.Name == "" {
+		// 无法识别的块按普通文本返回
+		p.events = append(p.events, toolEvent{Kind: toolEventText, Text: toolCallOpenTag + ">" + p.body.String() + toolCallCloseTag})
+		return
+	}
+	args := call.Arguments
+	if len(args) == 0 {
+		args = call.Parameters
+	}
+	arguments := "{}"
+	if len(args) > 0 {
+		var s string
+		if err := json.Unmarshal(args, &s); err == nil {
+			arguments = s
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, args); err == nil {
+				arguments = compact.String()
+			}
+		}
+	}
+	p.events = append(p.events,
+		toolEvent{Kind: toolEventStart, Index: p.count, ID: p.id, Name: call.Name},
+		toolEvent{Kind: toolEventArgs, Index: p.count, Text: arguments},
+	)
+	p.count++
+}
+
+// parseToolCalls 从完整的模型输出中解析正文和工具调用
+func parseToolCalls(text string, s *toolSettings) (string, []ToolCall) {
+	parser := newToolCallParser(s)
+	events := append(parser.Feed(text), parser.Flush()...)
+
+	var content strings.Builder
+	var calls []ToolCall
+	for _, ev := range events {
+		switch ev.Kind {
+		case toolEventText:
+			content.WriteString(ev.Text)
+		case toolEventStart:
+			calls = append(calls, ToolCall{ID: ev.ID, Type: "function", Function: FunctionCall{Name: ev.Name}})
+		case toolEventArgs:
+			calls[ev.Index].Function.Arguments += ev.Text
+		}
+	}
+
+	if len(calls) == 0 {
+		return content.String(), nil
+	}
+	return strings.TrimSpace(content.String()), calls
+}
+
+// toolCallsDelta 构造流式响应中的 tool_calls / function_call 增量
+func toolCallsDelta(ev toolEvent, s *toolSettings) map[string]interface{} {
+	if s.Legacy {
+		fn := map[string]interface{}{"arguments": ev.Text}
+		if ev.Kind == toolEventStart {
+			fn["name"] = ev.Name
+		}
+		return map[string]interface{}{"function_call": fn}
+	}
+
+	call := map[string]interface{}{"index": ev.Index}
+	if ev.Kind == toolEventStart {
+		call["id"] = ev.ID
+		call["type"] = "function"
+		call["function"] = map[string]interface{}{"name": ev.Name, "arguments": ""}
+	} else {
+		call["function"] = map[string]interface{}{"arguments": ev.Text}
+	}
+	return map[string]interface{}{"tool_calls": []interface{}{call}}
+}
+
+// toolFinishReason 出现工具调用时的结束原因
+func toolFinishReason(s *toolSettings) string {
+	if s.Legacy {
+		return "function_call"
+	}
+	return "tool_calls"
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// directClient 不经过代理池时使用的长期 HTTP 客户端，所有请求共享同一个 Transport 的连接池
+var directClient *http.Client
+
+// connStats 通过 httptrace 收集的上游连接统计
+type connStats struct {
+	requests       int64
+	newConns       int64
+	reusedConns    int64
+	idleReused     int64
+	tlsHandshakes  int64
+	tlsHandshakeNs int64
+	connects       int64
+	connectNs      int64
+	dnsLookups     int64
+}
+
+var upstreamConnStats connStats
+
+// TransportStats Dashboard 展示的连接池配置和统计
+type TransportStats struct {
+	MaxIdleConnsPerHost int     `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     int     `json:"idle_conn_timeout"`
+	TLSHandshakeTimeout int     `json:"tls_handshake_timeout"`
+	KeepAlive           int     `json:"keepalive"`
+	HTTP2               bool    `json:"http2"`
+	Requests            int64   `json:"requests"`
+	NewConnections      int64   `json:"new_connections"`
+	ReusedConnections   int64   `json:"reused_connections"`
+	IdleReused          int64   `json:"idle_reused"`
+	ReuseRate           float64 `json:"reuse_rate"`
+	TLSHandshakes       int64   `json:"tls_handshakes"`
+	AvgTLSHandshakeMs   float64 `json:"avg_tls_handshake_ms"`
+	AvgConnectMs        float64 `json:"avg_connect_ms"`
+	DNSLookups          int64   `json:"dns_lookups"`
+}
+
+// newTransport 按配置创建 Transport，proxy 为 nil 时遵循 HTTP_PROXY/HTTPS_PROXY 环境变量
+func newTransport(proxy *url.URL) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(config.UpstreamKeepAlive) * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: config.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(config.UpstreamIdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(config.UpstreamTLSHandshakeTimeout) * time.Second,
+		ForceAttemptHTTP2:   config.UpstreamHTTP2,
+	}
+	if proxy != nil {
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	if !config.UpstreamHTTP2 {
+		// 非 nil 的空 TLSNextProto 会禁用 HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// newUpstreamClient 使用给定的 Transport 创建上游客户端，超时时间为 TIMEOUT
+func newUpstreamClient(t http.RoundTripper) *http.Client {
+	return &http.Client{Transport: t, Timeout: time.Duration(config.Timeout) * time.Second}
+}
+
+// initTransport 创建直连共享客户端，需要在 loadConfig 之后、loadUpstreams 之前调用
+func initTransport() {
+	directClient = newUpstreamClient(newTransport(nil))
+}
+
+// traceConnections 为上游请求附加 httptrace，统计连接复用和 TLS 握手情况
+func traceConnections(req *http.Request) *http.Request {
+	atomic.AddInt64(&upstreamConnStats.requests, 1)
+	// Happy Eyeballs 会并发拨号多个地址，回调可能在不同 goroutine 中执行，
+	// 开始时间按地址记录并用锁保护
+	var (
+		mu           sync.Mutex
+		tlsStart     time.Time
+		connectStart = make(map[string]time.Time)
+	)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&upstreamConnStats.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&upstreamConnStats.newConns, 1)
+			}
+			if info.WasIdle {
+				atomic.AddInt64(&upstreamConnStats.idleReused, 1)
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			atomic.AddInt64(&upstreamConnStats.dnsLookups, 1)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+"/"+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			start, ok := connectStart[network+"/"+addr]
+			delete(connectStart, network+"/"+addr)
+			mu.Unlock()
+			if err == nil && ok {
+				atomic.AddInt64(&upstreamConnStats.connects, 1)
+				atomic.AddInt64(&upstreamConnStats.connectNs, int64(time.Since(start)))
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			start := tlsStart
+			mu.Unlock()
+			if err == nil && !start.IsZero() {
+				atomic.AddInt64(&upstreamConnStats.tlsHandshakes, 1)
+				atomic.AddInt64(&upstreamConnStats.tlsHandshakeNs, int64(time.Since(start)))
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// getTransportData 返回连接池配置和统计
+func getTransportData() TransportStats {
+	s := TransportStats{
+		MaxIdleConnsPerHost: config.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:     config.UpstreamIdleConnTimeout,
+		TLSHandshakeTimeout: config.UpstreamTLSHandshakeTimeout,
+		KeepAlive:           config.UpstreamKeepAlive,
+		HTTP2:               config.UpstreamHTTP2,
+		Requests:            atomic.LoadInt64(&upstreamConnStats.requests),
+		NewConnections:      atomic.LoadInt64(&upstreamConnStats.newConns),
+		ReusedConnections:   atomic.LoadInt64(&upstreamConnStats.reusedConns),
+		IdleReused:          atomic.LoadInt64(&upstreamConnStats.idleReused),
+		TLSHandshakes:       atomic.LoadInt64(&upstreamConnStats.tlsHandshakes),
+		DNSLookups:          atomic.LoadInt64(&upstreamConnStats.dnsLookups),
+	}
+	if total := s.NewConnections + s.ReusedConnections; total > 0 {
+		s.ReuseRate = float64(s.ReusedConnections) / float64(total)
+	}
+	if s.TLSHandshakes > 0 {
+		s.AvgTLSHandshakeMs = float64(atomic.LoadInt64(&upstreamConnStats.tlsHandshakeNs)) / float64(s.TLSHandshakes) / 1e6
+	}
+	if connects := atomic.LoadInt64(&upstreamConnStats.connects); connects > 0 {
+		s.AvgConnectMs = float64(atomic.LoadInt64(&upstreamConnStats.connectNs)) / float64(connects) / 1e6
+	}
+	return s
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	balanceWeighted      = "weighted"
+	balanceLeastInFlight = "least_in_flight"
+	balanceLatency       = "latency"
+)
+
+const (
+	// latencySmoothing 最近延迟的指数加权系数，越大越偏向最新的一次请求
+	latencySmoothing = 0.3
+	// failureLatencyPenalty 请求失败时计入最近延迟的值，使 latency 策略避开出错的端点
+	failureLatencyPenalty = 5 * time.Second
+)
+
+// validBalanceStrategy 判断负载均衡策略名称是否有效
+func validBalanceStrategy(name string) bool {
+	switch name {
+	case balanceWeighted, balanceLeastInFlight, balanceLatency:
+		return true
+	}
+	return false
+}
+
+// UpstreamConfig upstreams.json 中单个上游端点的配置
+type UpstreamConfig struct {
+	Name    string            `json:"name,omitempty"`
+	BaseURL string            `json:"base_url"`
+	Weight  int               `json:"weight,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Proxies []string          `json:"proxies,omitempty"`
+}
+
+// upstreamConfigList upstreams.json 中一个 provider 的端点列表，值可以是单个对象，也可以是数组
+type upstreamConfigList []UpstreamConfig
+
+// UnmarshalJSON 同时接受对象和数组
+func (l *upstreamConfigList) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var single UpstreamConfig
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*l = upstreamConfigList{single}
+		return nil
+	}
+	var list []UpstreamConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("upstream entry must be an object or an array of objects")
+	}
+	*l = list
+	return nil
+}
+
+// upstream 一个上游端点的运行时配置和状态：基础地址、附加请求头、出站代理池，
+// 以及负载均衡使用的权重、进行中的请求数和最近延迟
+type upstream struct {
+	Provider string
+	Name     string
+	BaseURL  string
+	Weight   int
+	Headers  map[string]string
+	proxies  *proxyPool
+
+	inFlight      int64
+	requests      int64
+	failures      int64
+	currentWeight int
+	latency       time.Duration
+}
+
+// upstreamGroup 同一个 provider 的所有上游端点
+type upstreamGroup struct {
+	Provider  string
+	Endpoints []*upstream
+	mutex     sync.Mutex
+}
+
+var (
+	upstreams      = make(map[string]*upstreamGroup)
+	upstreamsMutex sync.RWMutex
+)
+
+// newUpstream 校验配置并创建上游端点
+func newUpstream(name string, cfg UpstreamConfig) (*upstream, error) {
+	baseURL := strings.TrimRight(strings.TrimSpace(cfg.BaseURL), "/")
+	if baseURL == "" {
+		return nil, fmt.Errorf("upstream '%s': base_url is required", name)
+	}
+	pool, err := newProxyPool(cfg.Proxies)
+	if err != nil {
+		return nil, fmt.Errorf("upstream '%s': %v", name, err)
+	}
+	weight := cfg.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return &upstream{Name: name, BaseURL: baseURL, Weight: weight, Headers: cfg.Headers, proxies: pool}, nil
+}
+
+// newUpstreamGroup 创建 provider 的端点组，未命名的端点按 provider 名称和序号命名
+func newUpstreamGroup(provider string, configs []UpstreamConfig) (*upstreamGroup, error) {
+	group := &upstreamGroup{Provider: provider}
+	for i, cfg := range configs {
+		name := cfg.Name
+		if name == "" {
+			name = provider
+			if len(configs) > 1 {
+				name = fmt.Sprintf("%s-%d", provider, i+1)
+			}
+		}
+		u, err := newUpstream(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		u.Provider = provider
+		group.Endpoints = append(group.Endpoints, u)
+	}
+	if len(group.Endpoints) == 0 {
+		return nil, fmt.Errorf("upstream '%s': at least one endpoint is required", provider)
+	}
+	return group, nil
+}
+
+// loadUpstreams 用环境变量中的配置创建 TalkAI 上游（UPSTREAM_BASE_URL 可以用逗号分隔多个地址），
+// 再用 upstreams.json（可选）覆盖或补充
+func loadUpstreams() {
+	var envConfigs []UpstreamConfig
+	for _, baseURL := range strings.Split(config.UpstreamBaseURL, ",") {
+		if strings.TrimSpace(baseURL) == "" {
+			continue
+		}
+		envConfigs = append(envConfigs, UpstreamConfig{
+			BaseURL: baseURL,
+			Headers: config.UpstreamHeaders,
+			Proxies: config.UpstreamProxies,
+		})
+	}
+	configs := map[string][]UpstreamConfig{defaultProviderName: envConfigs}
+
+	data, err := os.ReadFile("upstreams.json")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取 upstreams.json 出错: %v", err)
+		}
+	} else {
+		var fileConfigs map[string]upstreamConfigList
+		if err := json.Unmarshal(data, &fileConfigs); err != nil {
+			log.Printf("解析 upstreams.json 出错: %v", err)
+		}
+		for name, list := range fileConfigs {
+			configs[name] = list
+		}
+	}
+
+	upstreamsMutex.Lock()
+	defer upstreamsMutex.Unlock()
+	for name, list := range configs {
+		group, err := newUpstreamGroup(name, list)
+		if err != nil {
+			log.Printf("上游配置无效: %v", err)
+			continue
+		}
+		upstreams[name] = group
+	}
+}
+
+// upstreamGroupFor 返回指定 provider 的端点组，未配置时返回 nil
+func upstreamGroupFor(provider string) *upstreamGroup {
+	upstreamsMutex.RLock()
+	defer upstreamsMutex.RUnlock()
+	return upstreams[provider]
+}
+
+// Candidates 按负载均衡策略返回本次请求尝试端点的顺序，失败时依次切换到下一个。
+// 三种策略都先用平滑加权轮询决定首选端点，least_in_flight 和 latency 再按各自的指标稳定排序，
+// 指标相同时保持加权轮询的顺序
+func (g *upstreamGroup) Candidates(strategy string) []*upstream {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// 平滑加权轮询（与 nginx 相同）：每个端点的当前权重加上自身权重，选出最大的，再减去总权重
+	total := 0
+	var selected *upstream
+	for _, u := range g.Endpoints {
+		u.currentWeight += u.Weight
+		total += u.Weight
+		if selected == nil || u.currentWeight > selected.currentWeight {
+			selected = u
+		}
+	}
+	selected.currentWeight -= total
+
+	order := make([]*upstream, 0, len(g.Endpoints))
+	order = append(order, selected)
+	for _, u := range g.Endpoints {
+		if u != selected {
+			order = append(order, u)
+		}
+	}
+	rest := order[1:]
+	sort.SliceStable(rest, func(i, j int) bool { return rest[i].Weight > rest[j].Weight })
+
+	switch strategy {
+	case balanceLeastInFlight:
+		sort.SliceStable(order, func(i, j int) bool {
+			return atomic.LoadInt64(&order[i].inFlight) < atomic.LoadInt64(&order[j].inFlight)
+		})
+	case balanceLatency:
+		// 还没有延迟数据的端点排在前面，先探测一次
+		sort.SliceStable(order, func(i, j int) bool { return order[i].latency < order[j].latency })
+	}
+	return order
+}
+
+// begin 记录一次发往该端点的请求开始，返回的函数在请求结束（事件流关闭或请求失败）时调用
+func (u *upstream) begin() func() {
+	atomic.AddInt64(&u.inFlight, 1)
+	atomic.AddInt64(&u.requests, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt64(&u.inFlight, -1) })
+	}
+}
+
+// observe 记录一次请求的结果，用收到响应头的耗时更新最近延迟，失败时按 failureLatencyPenalty 计入
+func (g *upstreamGroup) observe(u *upstream, elapsed time.Duration, err error) {
+	if err != nil {
+		atomic.AddInt64(&u.failures, 1)
+		elapsed = failureLatencyPenalty
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if u.latency == 0 {
+		u.latency = elapsed
+	} else {
+		u.latency = time.Duration(latencySmoothing*float64(elapsed) + (1-latencySmoothing)*float64(u.latency))
+	}
+}
+
+// applyHeaders 在 provider 默认请求头的基础上应用上游配置的请求头，值为空字符串时删除该请求头
+func (u *upstream) applyHeaders(req *http.Request) {
+	for key, value := range u.Headers {
+		if value == "" {
+			req.Header.Del(key)
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+}
+
+// Do 使用 provider 账号池中的账号发送请求。上游因账号拒绝请求（401/403/429）时，
+// 换下一个可用账号重试；没有其他账号时把最后一次的响应返回给调用方。没有配置账号时直接发送
+func (u *upstream) Do(req *http.Request) (*http.Response, error) {
+	pool := accountPoolFor(u.Provider)
+	if pool == nil {
+		return u.send(req)
+	}
+
+	tried := make(map[*account]bool)
+	var resp *http.Response
+	for {
+		acct, err := pool.Pick(tried)
+		if err != nil {
+			if resp != nil {
+				return resp, nil
+			}
+			return nil, err
+		}
+		attempt := req.Clone(req.Context())
+		if resp != nil {
+			// 请求体已被上一次请求读取，需要重新获取
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		acct.apply(attempt)
+
+		resp, err = u.send(attempt)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		pool.Report(acct, resp, err)
+		if err != nil || !accountRejected(resp.StatusCode) {
+			return resp, err
+		}
+		tried[acct] = true
+	}
+}
+
+// send 通过代理池（未配置代理时直连）发送请求，并根据结果更新代理的健康状态
+func (u *upstream) send(req *http.Request) (*http.Response, error) {
+	req = traceConnections(req)
+	proxy := u.proxies.Pick()
+	if proxy == nil {
+		return directClient.Do(req)
+	}
+
+	resp, err := proxy.client.Do(req)
+	switch {
+	case req.Context().Err() != nil:
+		// 客户端断开导致的失败与代理无关，不计入健康状态
+	case err != nil:
+		u.proxies.Report(proxy, err)
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		u.proxies.Report(proxy, fmt.Errorf("proxy authentication required"))
+	default:
+		u.proxies.Report(proxy, nil)
+	}
+	return resp, err
+}
+
+// trackedStream 包装端点返回的事件流，关闭时结束该端点的进行中计数
+type trackedStream struct {
+	EventStream
+	done func()
+}
+
+func (s *trackedStream) Close() error {
+	s.done()
+	return s.EventStream.Close()
+}
+
+// upstreamName 返回熔断器和日志中使用的上游名称，没有配置端点的 provider 使用 provider 名称
+func upstreamName(p Provider, u *upstream) string {
+	if u == nil {
+		return p.Name()
+	}
+	return u.Name
+}
+
+// openUpstream 向选中的端点发起请求，并记录该端点的进行中请求数、失败次数和延迟
+func openUpstream(ctx context.Context, p Provider, group *upstreamGroup, u *upstream, req TalkAIRequest) (EventStream, error) {
+	if u == nil {
+		return p.Stream(ctx, nil, req)
+	}
+
+	done := u.begin()
+	start := time.Now()
+	stream, err := p.Stream(ctx, u, req)
+	if ctx.Err() == nil {
+		group.observe(u, time.Since(start), err)
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return &trackedStream{EventStream: stream, done: done}, nil
+}
+
+// UpstreamStatus Dashboard 展示的上游端点状态
+type UpstreamStatus struct {
+	Provider        string        `json:"provider"`
+	Name            string        `json:"name"`
+	BaseURL         string        `json:"base_url"`
+	Weight          int           `json:"weight"`
+	InFlight        int64         `json:"in_flight"`
+	Requests        int64         `json:"requests"`
+	Failures        int64         `json:"failures"`
+	RecentLatencyMs float64       `json:"recent_latency_ms"`
+	Proxies         []ProxyStatus `json:"proxies"`
+}
+
+// getUpstreamsData 返回所有上游端点及其代理的状态
+func getUpstreamsData() []UpstreamStatus {
+	upstreamsMutex.RLock()
+	defer upstreamsMutex.RUnlock()
+
+	result := []UpstreamStatus{}
+	for _, group := range upstreams {
+		group.mutex.Lock()
+		for _, u := range group.Endpoints {
+			result = append(result, UpstreamStatus{
+				Provider:        group.Provider,
+				Name:            u.Name,
+				BaseURL:         u.BaseURL,
+				Weight:          u.Weight,
+				InFlight:        atomic.LoadInt64(&u.inFlight),
+				Requests:        atomic.LoadInt64(&u.requests),
+				Failures:        atomic.LoadInt64(&u.failures),
+				RecentLatencyMs: float64(u.latency) / float64(time.Millisecond),
+				Proxies:         u.proxies.Status(),
+			})
+		}
+		group.mutex.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}